@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// adminHandler serves the admin API on its own listener. Every request must
+// carry the admin token as "Authorization: Bearer <token>".
+//
+//	GET  /admin/modules  cached modules and versions (?module= or ?match=)
+//	GET  /admin/stats    cache statistics
+//	POST /admin/purge    delete a version (?module=&version=), a module
+//	                     (?module=) or modules matching globs (?match=)
+//	POST /admin/refresh  refetch the cached lists and @latest of modules
+//	                     (?module= or ?match=), ignoring the list TTL
+//	POST /admin/warm     download the module versions named by the request
+//	                     body (?format=gomod, gosum or list)
+type adminHandler struct {
+	proxy           *Proxy
+	token           string
+	warmConcurrency int
+	mux             *http.ServeMux
+}
+
+// maxWarmInput bounds the request body of /admin/warm
+const maxWarmInput = 8 << 20
+
+// newAdminHandler creates the admin API handler for p, protected by token.
+// Warm-ups download warmConcurrency module versions at a time by default.
+func newAdminHandler(p *Proxy, token string, warmConcurrency int) (http.Handler, error) {
+	if token == "" {
+		return nil, errors.New("the admin API requires a token")
+	}
+	a := &adminHandler{proxy: p, token: token, warmConcurrency: warmConcurrency, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/admin/modules", a.handleModules)
+	a.mux.HandleFunc("/admin/stats", a.handleStats)
+	a.mux.HandleFunc("/admin/purge", a.handlePurge)
+	a.mux.HandleFunc("/admin/refresh", a.handleRefresh)
+	a.mux.HandleFunc("/admin/warm", a.handleWarm)
+	return a, nil
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &accessRecord{id: requestID(r)}
+	w.Header().Set(requestIDHeader, rec.id)
+	r = r.WithContext(withAccess(r.Context(), rec))
+
+	sw := &statusWriter{ResponseWriter: w}
+	start := time.Now()
+	defer func() {
+		logger(r.Context()).Info("admin", "client", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+			"query", r.URL.RawQuery, "status", sw.statusCode(), "duration_ms", millis(time.Since(start)))
+	}()
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		sw.Header().Set("WWW-Authenticate", `Bearer realm="goproxy admin"`)
+		writeAdminError(sw, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	a.mux.ServeHTTP(sw, r)
+}
+
+// CachedModule describes the cache entries of one module. Sizes include the
+// ".meta" sidecars of the entries.
+type CachedModule struct {
+	Module   string           `json:"module"`
+	Size     int64            `json:"size"`
+	Modified time.Time        `json:"modified"`
+	List     *CachedFile      `json:"list,omitempty"`
+	Latest   *CachedFile      `json:"latest,omitempty"`
+	Versions []*CachedVersion `json:"versions"`
+
+	entries []StorageInfo // all cache entries of the module
+}
+
+// CachedVersion describes the cache entries of one module version
+type CachedVersion struct {
+	Version  string      `json:"version"`
+	Size     int64       `json:"size"`
+	Modified time.Time   `json:"modified"`
+	Info     *CachedFile `json:"info,omitempty"`
+	Mod      *CachedFile `json:"mod,omitempty"`
+	Zip      *CachedFile `json:"zip,omitempty"`
+
+	entries []StorageInfo // cache entries of the version
+}
+
+// CachedFile describes one cached artifact
+type CachedFile struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// add accounts for the storage entry e in f
+func (f *CachedFile) add(e StorageInfo) {
+	f.Size += e.Size
+	if e.ModTime.After(f.Modified) {
+		f.Modified = e.ModTime
+	}
+}
+
+// parseCacheKey returns the module request cached under key, which may also
+// be the ".meta" sidecar of the entry. It reports false for entries that are
+// not module artifacts, such as checksum database tiles.
+func parseCacheKey(key string) (*moduleRequest, bool) {
+	mreq, err := parseRequest(strings.TrimSuffix(key, ".meta"))
+	return mreq, err == nil
+}
+
+// groupModules groups the module artifacts among entries by module and
+// version, keeping the modules for which keep returns true. Modules are
+// sorted by path and versions in semver order.
+func groupModules(entries []StorageInfo, keep func(modPath string) bool) []*CachedModule {
+	mods := make(map[string]*CachedModule)
+	versions := make(map[string]map[string]*CachedVersion)
+	for _, e := range entries {
+		mreq, ok := parseCacheKey(e.Key)
+		if !ok || !keep(mreq.Module) {
+			continue
+		}
+		m := mods[mreq.Module]
+		if m == nil {
+			m = &CachedModule{Module: mreq.Module, Versions: []*CachedVersion{}}
+			mods[mreq.Module] = m
+			versions[mreq.Module] = make(map[string]*CachedVersion)
+		}
+		m.entries = append(m.entries, e)
+		m.Size += e.Size
+		if e.ModTime.After(m.Modified) {
+			m.Modified = e.ModTime
+		}
+
+		var file **CachedFile
+		switch mreq.Kind {
+		case kindList:
+			file = &m.List
+		case kindLatest:
+			file = &m.Latest
+		default:
+			v := versions[mreq.Module][mreq.Version]
+			if v == nil {
+				v = &CachedVersion{Version: mreq.Version}
+				versions[mreq.Module][mreq.Version] = v
+				m.Versions = append(m.Versions, v)
+			}
+			v.entries = append(v.entries, e)
+			v.Size += e.Size
+			if e.ModTime.After(v.Modified) {
+				v.Modified = e.ModTime
+			}
+			switch mreq.Kind {
+			case kindInfo:
+				file = &v.Info
+			case kindMod:
+				file = &v.Mod
+			default:
+				file = &v.Zip
+			}
+		}
+		if *file == nil {
+			*file = &CachedFile{}
+		}
+		(*file).add(e)
+	}
+
+	list := make([]*CachedModule, 0, len(mods))
+	for _, m := range mods {
+		sort.Slice(m.Versions, func(i, j int) bool {
+			return semver.Compare(m.Versions[i].Version, m.Versions[j].Version) < 0
+		})
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Module < list[j].Module })
+	return list
+}
+
+// moduleSelector selects modules by the "module" (exact path) or "match"
+// (comma-separated globs, like GOPRIVATE) parameter of q. Without either, it
+// selects every module unless required is set. It also returns the storage
+// key prefix that holds all selected entries.
+func moduleSelector(q url.Values, required bool) (keep func(string) bool, prefix string, err error) {
+	modPath, match := q.Get("module"), q.Get("match")
+	switch {
+	case modPath != "" && match != "":
+		return nil, "", errors.New("module and match are mutually exclusive")
+	case modPath != "":
+		escPath, err := module.EscapePath(modPath)
+		if err != nil {
+			return nil, "", err
+		}
+		// Module paths never contain "@", so this prefix excludes nested modules
+		return func(m string) bool { return m == modPath }, escPath + "/@", nil
+	case match != "":
+		return func(m string) bool { return module.MatchPrefixPatterns(match, m) }, "", nil
+	case required:
+		return nil, "", errors.New("module or match is required")
+	default:
+		return func(string) bool { return true }, "", nil
+	}
+}
+
+// cachedModules lists the cached modules selected by the query of r (see
+// moduleSelector). On failure it writes the error response and returns false.
+func (a *adminHandler) cachedModules(w http.ResponseWriter, r *http.Request, required bool) ([]*CachedModule, bool) {
+	keep, prefix, err := moduleSelector(r.URL.Query(), required)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	entries, err := a.proxy.storage.List(r.Context(), prefix)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return groupModules(entries, keep), true
+}
+
+// handleModules handles GET /admin/modules
+func (a *adminHandler) handleModules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	mods, ok := a.cachedModules(w, r, false)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, mods)
+}
+
+// CacheStats summarizes the cache storage and the proxy's cache counters
+type CacheStats struct {
+	Entries  int                  `json:"entries"`
+	Bytes    int64                `json:"bytes"`
+	Modules  int                  `json:"modules"`
+	Versions int                  `json:"versions"`
+	Kinds    map[string]KindStats `json:"kinds"`
+	Quota    int64                `json:"quota,omitempty"`
+	Policy   string               `json:"policy,omitempty"`
+	Evicted  *KindStats           `json:"evicted,omitempty"`
+	Tiers    map[string]TierStats `json:"tiers,omitempty"`
+	// VerifyFailures counts downloads rejected by checksum verification
+	VerifyFailures int64 `json:"verify_failures"`
+}
+
+// KindStats counts cache entries and their size
+type KindStats struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// handleStats handles GET /admin/stats
+func (a *adminHandler) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p := a.proxy
+	entries, err := p.storage.List(r.Context(), "")
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	stats := CacheStats{Entries: len(entries), Kinds: make(map[string]KindStats)}
+	for _, e := range entries {
+		kind := "other"
+		if mreq, ok := parseCacheKey(e.Key); ok {
+			kind = mreq.Kind.String()
+		} else if strings.HasPrefix(e.Key, "sumdb/") {
+			kind = "sumdb"
+		}
+		k := stats.Kinds[kind]
+		k.Entries++
+		k.Bytes += e.Size
+		stats.Kinds[kind] = k
+		stats.Bytes += e.Size
+	}
+	p.size.set(stats.Bytes)
+	for _, m := range groupModules(entries, func(string) bool { return true }) {
+		stats.Modules++
+		stats.Versions += len(m.Versions)
+	}
+
+	if p.janitor != nil {
+		stats.Quota, stats.Policy = p.janitor.maxSize, p.janitor.policy
+		stats.Evicted = &KindStats{Entries: p.janitor.evictedFiles.Load(), Bytes: p.janitor.evictedBytes.Load()}
+	}
+	if p.tiered != nil {
+		memory, storage := p.tiered.stats()
+		stats.Tiers = map[string]TierStats{"memory": memory, "storage": storage}
+	}
+	if p.verifier != nil {
+		stats.VerifyFailures = p.verifier.failures.Load()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// PurgeResult reports what a purge deleted
+type PurgeResult struct {
+	Modules []string `json:"modules"`
+	Entries int      `json:"entries"`
+	Bytes   int64    `json:"bytes"`
+}
+
+// handlePurge handles POST /admin/purge
+func (a *adminHandler) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	version := r.URL.Query().Get("version")
+	if version != "" && r.URL.Query().Get("module") == "" {
+		writeAdminError(w, http.StatusBadRequest, "version requires module")
+		return
+	}
+	mods, ok := a.cachedModules(w, r, true)
+	if !ok {
+		return
+	}
+
+	res := PurgeResult{Modules: []string{}}
+	for _, m := range mods {
+		entries := m.entries
+		if version != "" {
+			entries = nil
+			for _, v := range m.Versions {
+				if v.Version == version {
+					entries = v.entries
+				}
+			}
+			if entries == nil {
+				continue
+			}
+		}
+		n, size, err := a.proxy.purge(r.Context(), entries)
+		res.Entries += n
+		res.Bytes += size
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res.Modules = append(res.Modules, m.Module)
+	}
+	logger(r.Context()).Info("Purged cache entries", "modules", len(res.Modules), "entries", res.Entries, "bytes", res.Bytes)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// purge deletes the cache entries, waiting for clients still reading them.
+// It returns how many entries and bytes it deleted.
+func (p *Proxy) purge(ctx context.Context, entries []StorageInfo) (int, int64, error) {
+	var n int
+	var size int64
+	for _, e := range entries {
+		// Sidecars are guarded by the lock of their entry
+		unlock := p.locks.Lock(strings.TrimSuffix(e.Key, ".meta"))
+		err := p.storage.Delete(ctx, e.Key)
+		unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return n, size, err
+		}
+		n++
+		size += e.Size
+	}
+	return n, size, nil
+}
+
+// Outcomes of refreshing a list or @latest entry
+const (
+	refreshUpdated   = "updated"   // upstream sent a new copy
+	refreshUnchanged = "unchanged" // upstream confirmed the cached copy (304)
+	refreshFailed    = "failed"    // the cached copy was kept
+)
+
+// RefreshResult reports the outcome of refreshing one cache entry
+type RefreshResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleRefresh handles POST /admin/refresh
+func (a *adminHandler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if a.proxy.offline {
+		writeAdminError(w, http.StatusConflict, "refresh is not available in offline mode")
+		return
+	}
+	mods, ok := a.cachedModules(w, r, true)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	results := []RefreshResult{}
+	for _, m := range mods {
+		var keys []string
+		if m.List != nil {
+			key, _ := listKey(m.Module)
+			keys = append(keys, key)
+		}
+		if m.Latest != nil {
+			key, _ := latestKey(m.Module)
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			mreq, err := parseRequest(key)
+			if err != nil {
+				continue
+			}
+			var validate func([]byte) error
+			if mreq.Kind == kindLatest {
+				validate = validateJSON
+			}
+
+			res := RefreshResult{Key: key, Status: refreshUpdated}
+			_, status, err := a.proxy.fetchMutable(ctx, mreq, 0, validate)
+			switch {
+			case err != nil:
+				res.Status, res.Error = refreshFailed, err.Error()
+			case status == cacheStale:
+				res.Status, res.Error = refreshFailed, "upstream failed; see the log"
+			case status == cacheRevalidated:
+				res.Status = refreshUnchanged
+			}
+			results = append(results, res)
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleWarm handles POST /admin/warm. The body is a go.mod file, a go.sum
+// file or a module@version list, as selected by the format parameter (list
+// by default); the concurrency parameter overrides -warm-concurrency.
+func (a *adminHandler) handleWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if a.proxy.offline {
+		writeAdminError(w, http.StatusConflict, "warm-up is not available in offline mode")
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = warmList
+	}
+	concurrency := a.warmConcurrency
+	if c := q.Get("concurrency"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid concurrency %q", c))
+			return
+		}
+		concurrency = n
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmInput))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	targets, err := parseWarmInput(format, data)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, a.proxy.warm(r.Context(), targets, concurrency))
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeAdminError writes an admin API error as {"error": msg}
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminToken is the admin token of newTestAdmin
+const testAdminToken = "secret"
+
+// newTestAdmin returns the admin API handler of p
+func newTestAdmin(t *testing.T, p *Proxy) http.Handler {
+	t.Helper()
+	h, err := newAdminHandler(p, testAdminToken, defaultWarmConcurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// adminDo sends an authorized admin request and decodes the JSON response
+// into v, if not nil
+func adminDo(t *testing.T, h http.Handler, method, target, body string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, target, err, w.Body)
+		}
+	}
+	return w
+}
+
+func TestAdminWarm(t *testing.T) {
+	files := make(map[string]string)
+	var list strings.Builder
+	for i := 0; i < 8; i++ {
+		v := fmt.Sprintf("v1.0.%d", i)
+		files["example.com/m/@v/"+v+".info"] = fmt.Sprintf(`{"Version":%q}`, v)
+		files["example.com/m/@v/"+v+".mod"] = "module example.com/m\n"
+		files["example.com/m/@v/"+v+".zip"] = "zip of " + v
+		fmt.Fprintf(&list, "example.com/m@%s\n", v)
+	}
+	upstream := newFakeUpstream(t, files)
+	storage := newMemStorage()
+	p := newTestProxy(t, upstream, storage)
+	h := newTestAdmin(t, p)
+
+	var report WarmReport
+	if w := adminDo(t, h, http.MethodPost, "/admin/warm", list.String(), &report); w.Code != http.StatusOK {
+		t.Fatalf("warm = %d %s", w.Code, w.Body)
+	}
+	if report.Fetched != 8 || report.Cached != 0 || report.Failed != 0 {
+		t.Errorf("first warm-up: %+v", report)
+	}
+	for key, body := range files {
+		if got := string(storage.data(key)); got != body {
+			t.Errorf("%s cached as %q, want %q", key, got, body)
+		}
+	}
+
+	if w := adminDo(t, h, http.MethodPost, "/admin/warm", list.String(), &report); w.Code != http.StatusOK {
+		t.Fatalf("warm = %d %s", w.Code, w.Body)
+	}
+	if report.Cached != 8 || report.Fetched != 0 || report.Failed != 0 {
+		t.Errorf("second warm-up: %+v", report)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	p := newTestProxy(t, newFakeUpstream(t, nil), newMemStorage())
+	h := newTestAdmin(t, p)
+	for _, auth := range []string{"", "Bearer", "Bearer wrong", "Basic " + testAdminToken, "bearer " + testAdminToken} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: %d, want 401 with WWW-Authenticate", auth, w.Code)
+		}
+	}
+	if w := adminDo(t, h, http.MethodGet, "/admin/stats", "", nil); w.Code != http.StatusOK {
+		t.Errorf("authorized request: %d %s", w.Code, w.Body)
+	}
+
+	if _, err := newAdminHandler(p, "", defaultWarmConcurrency); err == nil {
+		t.Errorf("admin API created without a token")
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	storage := newMemStorage()
+	var keys []string
+	for _, mod := range []string{"example.com/m", "example.com/m/sub", "example.com/other"} {
+		keys = append(keys, mod+"/@v/list", mod+"/@v/list.meta")
+		for _, v := range []string{"v1.0.0", "v1.1.0"} {
+			for _, ext := range []string{".info", ".mod", ".zip"} {
+				keys = append(keys, mod+"/@v/"+v+ext)
+			}
+		}
+	}
+	putSized(t, storage, 10, keys...)
+	p := newTestProxy(t, newFakeUpstream(t, nil), storage)
+	h := newTestAdmin(t, p)
+
+	for _, tt := range []struct {
+		query   string
+		modules string // purged
+		entries int
+		gone    []string // keys deleted, besides those of earlier purges
+	}{
+		{"module=example.com/m&version=v1.0.0", "example.com/m", 3,
+			[]string{"example.com/m/@v/v1.0.0.info", "example.com/m/@v/v1.0.0.mod", "example.com/m/@v/v1.0.0.zip"}},
+		{"module=example.com/m&version=v1.2.0", "", 0, nil},
+		// Nested modules are modules of their own
+		{"module=example.com/m", "example.com/m", 5,
+			[]string{"example.com/m/@v/list", "example.com/m/@v/list.meta", "example.com/m/@v/v1.1.0.info", "example.com/m/@v/v1.1.0.mod", "example.com/m/@v/v1.1.0.zip"}},
+		{"match=example.com/o*", "example.com/other", 8, nil},
+	} {
+		var res PurgeResult
+		if w := adminDo(t, h, http.MethodPost, "/admin/purge?"+tt.query, "", &res); w.Code != http.StatusOK {
+			t.Fatalf("purge ?%s = %d %s", tt.query, w.Code, w.Body)
+		}
+		if strings.Join(res.Modules, " ") != tt.modules || res.Entries != tt.entries || res.Bytes != int64(10*tt.entries) {
+			t.Errorf("purge ?%s = %+v, want %d entries of %s", tt.query, res, tt.entries, tt.modules)
+		}
+		for _, key := range tt.gone {
+			if storage.data(key) != nil {
+				t.Errorf("purge ?%s left %s", tt.query, key)
+			}
+		}
+	}
+	if left := storedKeys(t, storage); strings.Count(left, " ") != 7 || strings.Contains(left, "other") || strings.Contains(left, "example.com/m/@") {
+		t.Errorf("left after the purges: %s, want the entries of example.com/m/sub", left)
+	}
+
+	for _, tt := range []struct {
+		method, query string
+		code          int
+	}{
+		{http.MethodPost, "", http.StatusBadRequest},
+		{http.MethodPost, "version=v1.0.0", http.StatusBadRequest},
+		{http.MethodPost, "module=example.com/m/sub&match=example.com/*", http.StatusBadRequest},
+		{http.MethodPost, "module=Example.com/m/sub/", http.StatusBadRequest},
+		{http.MethodGet, "module=example.com/m/sub", http.StatusMethodNotAllowed},
+	} {
+		if w := adminDo(t, h, tt.method, "/admin/purge?"+tt.query, "", nil); w.Code != tt.code {
+			t.Errorf("%s /admin/purge?%s = %d, want %d", tt.method, tt.query, w.Code, tt.code)
+		}
+	}
+	if left := storedKeys(t, storage); strings.Count(left, " ") != 7 {
+		t.Errorf("invalid purges deleted entries: %s", left)
+	}
+}
+
+func TestAdminRefresh(t *testing.T) {
+	const key = "example.com/m/@v/list"
+	upstream := newListUpstream(t)
+	storage := newMemStorage()
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: storage, ListTTL: time.Hour})
+	h := newTestAdmin(t, p)
+	get(p, "/"+key)
+
+	refresh := func() string {
+		t.Helper()
+		var results []RefreshResult
+		if w := adminDo(t, h, http.MethodPost, "/admin/refresh?module=example.com/m", "", &results); w.Code != http.StatusOK {
+			t.Fatalf("refresh = %d %s", w.Code, w.Body)
+		}
+		if len(results) != 1 || results[0].Key != key {
+			t.Fatalf("refresh results: %+v", results)
+		}
+		return results[0].Status
+	}
+
+	// The refresh ignores the TTL
+	if status := refresh(); status != refreshUnchanged {
+		t.Errorf("refresh of a current list: %s, want %s", status, refreshUnchanged)
+	}
+	if n := upstream.hitCount(key); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+	storage.Delete(context.Background(), key+".meta") // no validators
+	if status := refresh(); status != refreshUpdated {
+		t.Errorf("refresh without validators: %s, want %s", status, refreshUpdated)
+	}
+	upstream.set(http.StatusInternalServerError)
+	if status := refresh(); status != refreshFailed {
+		t.Errorf("refresh with upstream failing: %s, want %s", status, refreshFailed)
+	}
+	upstream.set(0)
+
+	// A refresh sharing the revalidation of an expired list by a client
+	// request reports its outcome
+	age(t, p, key, 2*time.Hour)
+	release := make(chan struct{})
+	upstream.mu.Lock()
+	serve := upstream.handler
+	upstream.handler = func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		serve(w, r)
+	}
+	upstream.mu.Unlock()
+	done := make(chan int)
+	go func() {
+		done <- get(p, "/"+key).Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	status := make(chan string)
+	go func() {
+		status <- refresh()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("GET = %d", code)
+	}
+	if s := <-status; s != refreshUnchanged {
+		t.Errorf("refresh coalesced with a revalidation: %s, want %s", s, refreshUnchanged)
+	}
+}
@@ -1,41 +1,188 @@
 package main
 
 import (
-	"os"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
-// cachePath converts a URL path to a safe filesystem path
-func cachePath(baseDir, urlPath string) string {
+// cachePath converts a cache key to a filesystem path inside baseDir. Keys
+// that are absolute, contain .. elements or would otherwise resolve outside
+// baseDir are rejected.
+func cachePath(baseDir, key string) (string, error) {
+	if strings.ContainsAny(key, "\\\x00") {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
 	// Sanitize path for filesystem - replace / with OS-specific separator
-	safePath := strings.ReplaceAll(urlPath, "/", string(filepath.Separator))
-	return filepath.Join(baseDir, safePath)
+	safePath := filepath.FromSlash(key)
+	if !filepath.IsLocal(safePath) {
+		return "", fmt.Errorf("cache key %q escapes the cache directory", key)
+	}
+	return filepath.Join(baseDir, safePath), nil
 }
 
-// readCache reads data from the cache file
-func readCache(path string) ([]byte, error) {
-	return os.ReadFile(path)
+// Cache keys mirror the proxy URL layout, with module paths and versions in
+// the Go module case-encoding (an upper-case letter X is stored as !x) so that
+// keys never collide on case-insensitive filesystems.
+
+// listKey returns the cache key of a module's @v/list
+func listKey(modPath string) (string, error) {
+	escPath, err := module.EscapePath(modPath)
+	if err != nil {
+		return "", err
+	}
+	return escPath + "/@v/list", nil
 }
 
-// writeCache writes data to cache atomically using temp file + rename
-func writeCache(path string, data []byte) error {
-	// Create directory if needed
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
+// latestKey returns the cache key of a module's @latest
+func latestKey(modPath string) (string, error) {
+	escPath, err := module.EscapePath(modPath)
+	if err != nil {
+		return "", err
 	}
+	return escPath + "/@latest", nil
+}
 
-	// Write atomically using temp file
-	tmpPath := path + ".tmp"
-	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
-		return err
+// versionKey returns the cache key of a version's .info, .mod or .zip
+func versionKey(modPath, version, ext string) (string, error) {
+	escPath, err := module.EscapePath(modPath)
+	if err != nil {
+		return "", err
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return escPath + "/@v/" + escVersion + ext, nil
+}
+
+// readCache reads a whole cache entry into memory
+func (p *Proxy) readCache(ctx context.Context, key string) ([]byte, error) {
+	r, _, err := p.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// writeCache stores data as the cache entry key, atomically
+func (p *Proxy) writeCache(ctx context.Context, key string, data []byte) error {
+	return p.storage.Put(ctx, key, bytes.NewReader(data))
+}
+
+// cachedInfos calls fn with the version and contents of every valid cached
+// .info file under a module's @v/ key prefix
+func (p *Proxy) cachedInfos(ctx context.Context, modPrefix string, fn func(version string, data []byte)) {
+	entries, err := p.storage.List(ctx, modPrefix)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Key, ".info") || strings.Contains(strings.TrimPrefix(entry.Key, modPrefix), "/") {
+			continue
+		}
+		data, err := p.readCache(ctx, entry.Key)
+		if err != nil {
+			continue
+		}
+		var info struct {
+			Version string
+		}
+		if err := json.Unmarshal(data, &info); err != nil || !semver.IsValid(info.Version) {
+			continue
+		}
+		fn(info.Version, data)
 	}
-	return os.Rename(tmpPath, path)
 }
 
-// cacheExists checks if a cache file exists
-func cacheExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+// latestFromCache picks the newest version among the cached .info files under
+// a module's @v/ key prefix and returns its contents. Like the go command, it
+// prefers releases over pre-releases and pre-releases over pseudo-versions.
+func (p *Proxy) latestFromCache(ctx context.Context, modPrefix string) ([]byte, bool) {
+	var best []byte
+	var bestVersion string
+	p.cachedInfos(ctx, modPrefix, func(version string, data []byte) {
+		if best == nil || newerVersion(version, bestVersion) {
+			best, bestVersion = data, version
+		}
+	})
+	return best, best != nil
 }
 
+// listFromCache builds an @v/list response from the cached .info files under
+// a module's @v/ key prefix. Like upstream lists, it leaves out
+// pseudo-versions, so a module with only pseudo-versions cached gets an
+// empty list.
+func (p *Proxy) listFromCache(ctx context.Context, modPrefix string) ([]byte, bool) {
+	found := false
+	var list strings.Builder
+	var versions []string
+	p.cachedInfos(ctx, modPrefix, func(version string, data []byte) {
+		found = true
+		if !module.IsPseudoVersion(version) {
+			versions = append(versions, version)
+		}
+	})
+	semver.Sort(versions)
+	for _, v := range versions {
+		list.WriteString(v + "\n")
+	}
+	return []byte(list.String()), found
+}
+
+// newerVersion reports whether v should be preferred over old as @latest
+func newerVersion(v, old string) bool {
+	if rank, oldRank := versionRank(v), versionRank(old); rank != oldRank {
+		return rank > oldRank
+	}
+	return semver.Compare(v, old) > 0
+}
+
+// versionRank orders releases above pre-releases above pseudo-versions
+func versionRank(v string) int {
+	switch {
+	case module.IsPseudoVersion(v):
+		return 0
+	case semver.Prerelease(v) != "":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// cacheMeta holds the HTTP validators of a mutable cache entry and when it
+// was last fetched or revalidated. It is stored next to the entry with a
+// ".meta" suffix.
+type cacheMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched,omitempty"`
+}
+
+// readCacheMeta reads the metadata stored for the cache entry key. A missing
+// or unreadable meta entry yields empty validators and a zero Fetched time.
+func (p *Proxy) readCacheMeta(ctx context.Context, key string) cacheMeta {
+	var meta cacheMeta
+	if data, err := p.readCache(ctx, key+".meta"); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+// writeCacheMeta stores the metadata for the cache entry key
+func (p *Proxy) writeCacheMeta(ctx context.Context, key string, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return p.writeCache(ctx, key+".meta", data)
+}
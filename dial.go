@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// connectionAttemptDelay is how long Happy Eyeballs waits for a connection
+// attempt before racing the next address against it (RFC 8305, section 5)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// dialFunc is the signature of net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// createDialer creates a custom dialer with DNS resolver support. Without a
+// resolver, the system resolver and net.Dialer's own Happy Eyeballs are used.
+func createDialer(dnsResolver DNSResolver) dialFunc {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if dnsResolver == nil {
+		return dialer.DialContext
+	}
+	return resolvingDialer(dnsResolver, dialer.DialContext)
+}
+
+// resolvingDialer returns a dial function that resolves host names with
+// dnsResolver and connects to their addresses through dial, racing them with
+// Happy Eyeballs and falling back across all of them
+func resolvingDialer(dnsResolver DNSResolver, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			ips, err = dnsResolver.LookupIP(ctx, host)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+			}
+		}
+		return dialHappyEyeballs(ctx, dial, network, ips, port)
+	}
+}
+
+// sortAddresses returns the addresses usable for network, alternating
+// between IPv6 and IPv4 and starting with IPv6 (RFC 8305, section 4)
+func sortAddresses(network string, ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if !strings.HasSuffix(network, "6") {
+				v4 = append(v4, ip)
+			}
+		} else if !strings.HasSuffix(network, "4") {
+			v6 = append(v6, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+// dialHappyEyeballs connects to port on one of ips with Happy Eyeballs
+// (RFC 8305): it dials the addresses in sortAddresses order, starting the
+// next attempt as soon as the previous one fails or after
+// connectionAttemptDelay, and returns the first connection established.
+// Slower attempts are canceled, and connections that still succeed are
+// closed. If every attempt fails, it returns the first error.
+func dialHappyEyeballs(ctx context.Context, dial dialFunc, network string, ips []net.IP, port string) (net.Conn, error) {
+	addrs := sortAddresses(network, ips)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no %s addresses to dial", network)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	pending, next := 0, 0
+	start := func() {
+		address := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, address)
+			results <- result{conn, err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var delay <-chan time.Time
+		if next < len(addrs) {
+			timer = time.NewTimer(connectionAttemptDelay)
+			delay = timer.C
+		}
+
+		var r result
+		select {
+		case <-delay:
+			start()
+			continue
+		case r = <-results:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		pending--
+		if r.err == nil {
+			// Close the connections of attempts that still succeed
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		if next < len(addrs) && ctx.Err() == nil {
+			start()
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSortAddresses(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("192.0.2.3"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+	}
+	for _, tt := range []struct {
+		network string
+		ips     []net.IP
+		want    string
+	}{
+		{"tcp", ips, "2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 192.0.2.3"},
+		{"tcp4", ips, "192.0.2.1 192.0.2.2 192.0.2.3"},
+		{"tcp6", ips, "2001:db8::1 2001:db8::2"},
+		{"tcp", ips[:3], "192.0.2.1 192.0.2.2 192.0.2.3"},
+		{"tcp", ips[3:], "2001:db8::1 2001:db8::2"},
+		{"tcp6", ips[:3], ""},
+		{"udp", []net.IP{ips[0], ips[3], ips[4]}, "2001:db8::1 192.0.2.1 2001:db8::2"},
+	} {
+		var got []string
+		for _, ip := range sortAddresses(tt.network, tt.ips) {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("sortAddresses(%s, %v) = %v, want %s", tt.network, tt.ips, got, tt.want)
+		}
+	}
+}
+
+// fakeConn is a connection that records whether it was closed
+type fakeConn struct {
+	net.Conn
+	address string
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func newFakeConn(address string) *fakeConn {
+	c, _ := net.Pipe()
+	return &fakeConn{Conn: c, address: address, closed: make(chan struct{})}
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// fakeDialer dials addresses by looking up what to do in behaviors
+type fakeDialer struct {
+	// behaviors maps addresses to "refuse", "hang" (until the dial is
+	// canceled, then connect anyway, as if the connection was established
+	// just then) or "connect"
+	behaviors map[string]string
+
+	mu     sync.Mutex
+	dialed []string
+	conns  []*fakeConn
+}
+
+func (d *fakeDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+	switch d.behaviors[address] {
+	case "refuse":
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	case "hang":
+		<-ctx.Done()
+	}
+	c := newFakeConn(address)
+	d.mu.Lock()
+	d.conns = append(d.conns, c)
+	d.mu.Unlock()
+	return c, nil
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::2")}
+	d := &fakeDialer{behaviors: map[string]string{
+		"[2001:db8::1]:443": "hang",
+		"192.0.2.1:443":     "refuse",
+		"[2001:db8::2]:443": "connect",
+	}}
+
+	// The hanging first address delays the second attempt, whose failure
+	// starts the third one right away
+	start := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(), d.dial, "tcp", ips, "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < connectionAttemptDelay || elapsed > 2*connectionAttemptDelay {
+		t.Errorf("connected after %v, want one connection attempt delay", elapsed)
+	}
+	if address := conn.(*fakeConn).address; address != "[2001:db8::2]:443" {
+		t.Errorf("connected to %s, want [2001:db8::2]:443", address)
+	}
+	d.mu.Lock()
+	dialed := strings.Join(d.dialed, " ")
+	d.mu.Unlock()
+	if dialed != "[2001:db8::1]:443 192.0.2.1:443 [2001:db8::2]:443" {
+		t.Errorf("dialed %s", dialed)
+	}
+
+	// The canceled first attempt still connected, and that connection is
+	// closed
+	var loser *fakeConn
+	deadline := time.Now().Add(5 * time.Second)
+	for loser == nil && time.Now().Before(deadline) {
+		d.mu.Lock()
+		for _, c := range d.conns {
+			if c.address == "[2001:db8::1]:443" {
+				loser = c
+			}
+		}
+		d.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	if loser == nil {
+		t.Fatal("hanging attempt not canceled")
+	}
+	select {
+	case <-loser.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("losing connection not closed")
+	}
+	select {
+	case <-conn.(*fakeConn).closed:
+		t.Error("returned connection closed")
+	default:
+	}
+}
+
+func TestDialHappyEyeballsFailure(t *testing.T) {
+	d := &fakeDialer{behaviors: map[string]string{
+		"[2001:db8::1]:443": "refuse",
+		"192.0.2.1:443":     "refuse",
+	}}
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+	// Failing attempts do not wait for the delay, and the first error is
+	// returned
+	start := time.Now()
+	_, err := dialHappyEyeballs(context.Background(), d.dial, "tcp", ips, "443")
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("err = %v, want connection refused", err)
+	}
+	if elapsed := time.Since(start); elapsed >= connectionAttemptDelay {
+		t.Errorf("failed after %v, want no connection attempt delay", elapsed)
+	}
+	if len(d.dialed) != 2 || d.dialed[0] != "[2001:db8::1]:443" {
+		t.Errorf("dialed %v, want the IPv6 address first", d.dialed)
+	}
+
+	// Without addresses for the network nothing is dialed
+	d.dialed = nil
+	if _, err := dialHappyEyeballs(context.Background(), d.dial, "tcp6", ips[:1], "443"); err == nil || len(d.dialed) != 0 {
+		t.Errorf("dialing tcp6 without IPv6 addresses: err = %v, dialed %v", err, d.dialed)
+	}
+}
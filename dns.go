@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSResolver handles different DNS protocol types. LookupIP returns both
+// the IPv4 (A) and IPv6 (AAAA) addresses of host.
+type DNSResolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// ttlResolver is implemented by the resolvers of every DNS protocol, which
+// timedResolver turns into DNSResolvers. lookupIPTTL returns, besides the
+// addresses like LookupIP, their TTL or, for negative answers (see
+// isNegativeAnswer), the TTL of the error. A zero TTL means the server did
+// not say.
+type ttlResolver interface {
+	lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// lookupFunc queries one record type (dns.TypeA or dns.TypeAAAA) of host.
+// A name without records of that type yields no addresses and no error.
+type lookupFunc func(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error)
+
+// lookupResult is the answer to a query of one record type
+type lookupResult struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// lookupBoth resolves the A and AAAA records of host in parallel (see
+// combineLookups)
+func lookupBoth(ctx context.Context, host string, lookup lookupFunc) ([]net.IP, time.Duration, error) {
+	aaaa := make(chan lookupResult, 1)
+	go func() {
+		ips, ttl, err := lookup(ctx, host, dns.TypeAAAA)
+		aaaa <- lookupResult{ips, ttl, err}
+	}()
+	ips, ttl, err := lookup(ctx, host, dns.TypeA)
+	return combineLookups(host, lookupResult{ips, ttl, err}, <-aaaa)
+}
+
+// combineLookups merges the answers to the A and AAAA queries of host. It
+// only fails if neither query returned an address, so a broken IPv6 setup
+// on the DNS server's side does not break IPv4 and vice versa. The TTL is
+// the lower of both, or zero if one of the queries failed, so that the
+// missing addresses are looked up again soon.
+func combineLookups(host string, a, aaaa lookupResult) ([]net.IP, time.Duration, error) {
+	ttl := min(a.ttl, aaaa.ttl)
+	ips := append(a.ips, aaaa.ips...)
+	if len(ips) > 0 {
+		if a.err != nil || aaaa.err != nil {
+			ttl = 0
+		}
+		return ips, ttl, nil
+	}
+	switch {
+	case a.err != nil:
+		return nil, a.ttl, a.err
+	case aaaa.err != nil:
+		return nil, aaaa.ttl, aaaa.err
+	}
+	return nil, ttl, &noAddressesError{host}
+}
+
+// rcodeError is an answer from a DNS server other than success, such as
+// NXDOMAIN. Unlike transport errors, retrying elsewhere does not help.
+type rcodeError struct {
+	host  string
+	rcode int
+}
+
+func (e *rcodeError) Error() string {
+	return fmt.Sprintf("DNS server returned %s for %s", dns.RcodeToString[e.rcode], e.host)
+}
+
+// noAddressesError means that a name exists but has neither A nor AAAA
+// records
+type noAddressesError struct {
+	host string
+}
+
+func (e *noAddressesError) Error() string {
+	return fmt.Sprintf("no A or AAAA records found for %s", e.host)
+}
+
+// isNegativeAnswer reports whether err is an authoritative answer that host
+// has no addresses, which may be cached like addresses (RFC 2308)
+func isNegativeAnswer(err error) bool {
+	var rerr *rcodeError
+	var nerr *noAddressesError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &rerr):
+		return rerr.rcode == dns.RcodeNameError
+	case errors.As(err, &nerr):
+		return true
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// answerIPs returns the addresses of type qtype in a DNS reply for host and
+// how long they may be cached: the lowest TTL of the records in the answer,
+// or the negative caching TTL if there are no addresses
+func answerIPs(reply *dns.Msg, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, negativeTTL(reply), &rcodeError{host, reply.Rcode}
+	}
+	var ips []net.IP
+	var ttl uint32
+	for i, rr := range reply.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				ips = append(ips, rr.A)
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, negativeTTL(reply), nil
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// negativeTTL returns how long the absence of records in a reply may be
+// cached: the lower of the TTL and the MINIMUM field of the SOA record in
+// its authority section (RFC 2308, section 5)
+func negativeTTL(reply *dns.Msg) time.Duration {
+	for _, rr := range reply.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
+	}
+	return 0
+}
+
+// sharedConn is a connection to a DNS server that the queries of a resolver
+// share (see exchangeShared)
+type sharedConn interface {
+	closed() bool
+}
+
+// exchangeShared sends a query with exchange on the connection returned by
+// connection, which also reports whether an earlier lookup dialed it. The
+// server may have closed a connection that was idle for a while, so a query
+// that fails on a reused connection that is now closed is retried once on a
+// new one.
+func exchangeShared[C sharedConn](ctx context.Context, connection func(context.Context) (C, bool, error), exchange func(C) (*dns.Msg, error)) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := exchange(conn)
+		if err != nil && reused && attempt == 0 && conn.closed() && ctx.Err() == nil {
+			continue
+		}
+		return reply, err
+	}
+}
+
+// StandardDNSResolver uses UDP DNS
+type StandardDNSResolver struct {
+	server string
+}
+
+// lookupIPTTL uses the Go resolver, which does not report TTLs
+func (r *StandardDNSResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 5 * time.Second}
+			return d.DialContext(ctx, "udp", r.server)
+		},
+	}
+	// The Go resolver queries A and AAAA records in parallel
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, 0, nil
+}
+
+// DoH request modes, chosen with the fragment of the server URL
+// (https://server/dns-query#post)
+const (
+	dohGet  = "get"  // RFC 8484 wire format, base64url-encoded in ?dns= (the default)
+	dohPost = "post" // RFC 8484 wire format in the request body
+	dohJSON = "json" // the JSON API of Google and Cloudflare (application/dns-json)
+)
+
+// dohMessageType is the media type of RFC 8484 DNS messages
+const dohMessageType = "application/dns-message"
+
+// DoHResolver uses DNS-over-HTTPS
+type DoHResolver struct {
+	client   *http.Client
+	endpoint *url.URL
+	mode     string // dohGet, dohPost or dohJSON
+}
+
+// newDoHResolver creates a DoH resolver for a server URL, whose fragment
+// selects the request mode
+func newDoHResolver(dnsURL string) (*DoHResolver, error) {
+	endpoint, err := url.Parse(dnsURL)
+	if err != nil {
+		return nil, err
+	}
+	mode := endpoint.Fragment
+	switch mode {
+	case "":
+		mode = dohGet
+	case dohGet, dohPost, dohJSON:
+	default:
+		return nil, fmt.Errorf("invalid DoH mode %q (supported: %s, %s, %s)", mode, dohGet, dohPost, dohJSON)
+	}
+	endpoint.Fragment = ""
+	return &DoHResolver{
+		client: &http.Client{
+			// A transport of its own keeps one HTTP/2 connection to the
+			// server, which all lookups are multiplexed over
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				ForceAttemptHTTP2:   true,
+				TLSHandshakeTimeout: 5 * time.Second,
+				IdleConnTimeout:     90 * time.Second,
+				MaxIdleConnsPerHost: 2,
+			},
+			Timeout: 10 * time.Second,
+		},
+		endpoint: endpoint,
+		mode:     mode,
+	}, nil
+}
+
+func (r *DoHResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if r.mode == dohJSON {
+		return lookupBoth(ctx, host, r.lookupJSON)
+	}
+	return lookupBoth(ctx, host, r.lookup)
+}
+
+// lookup queries one record type of host with an RFC 8484 wire format
+// request
+func (r *DoHResolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), qtype)
+	m.Id = 0 // makes GET requests cacheable by HTTP caches (RFC 8484, section 4.1)
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if r.mode == dohPost {
+		req, err = http.NewRequestWithContext(ctx, "POST", r.endpoint.String(), bytes.NewReader(query))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Content-Type", dohMessageType)
+	} else {
+		u := *r.endpoint
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	req.Header.Set("Accept", dohMessageType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server returned status %d", resp.StatusCode)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(ct); mediaType != dohMessageType {
+		return nil, 0, fmt.Errorf("DoH server returned content type %q instead of %s", ct, dohMessageType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data); err != nil {
+		return nil, 0, err
+	}
+	return answerIPs(reply, host, qtype)
+}
+
+// lookupJSON queries one record type of host with the JSON API
+func (r *DoHResolver) lookupJSON(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	u := *r.endpoint
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", dns.TypeToString[qtype])
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server returned status %d", resp.StatusCode)
+	}
+
+	var dohResponse struct {
+		Status int `json:"Status"`
+		Answer []struct {
+			Type int    `json:"type"`
+			TTL  uint32 `json:"TTL"`
+			Data string `json:"data"`
+		} `json:"Answer"`
+		Authority []struct {
+			TTL uint32 `json:"TTL"`
+		} `json:"Authority"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&dohResponse); err != nil {
+		return nil, 0, err
+	}
+	// Like answerIPs; the SOA record of negative answers is only reported
+	// with its TTL
+	var negTTL uint32
+	for i, rr := range dohResponse.Authority {
+		if i == 0 || rr.TTL < negTTL {
+			negTTL = rr.TTL
+		}
+	}
+	if dohResponse.Status != dns.RcodeSuccess {
+		return nil, time.Duration(negTTL) * time.Second, &rcodeError{host, dohResponse.Status}
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for i, answer := range dohResponse.Answer {
+		if i == 0 || answer.TTL < ttl {
+			ttl = answer.TTL
+		}
+		if answer.Type == int(qtype) {
+			if ip := net.ParseIP(answer.Data); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, time.Duration(negTTL) * time.Second, nil
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// createDNSResolver creates appropriate DNS resolver based on URL, caching
+// its answers as configured by cache
+func createDNSResolver(dnsURL string, cache dnsCacheConfig) (DNSResolver, error) {
+	if dnsURL == "" {
+		return nil, nil
+	}
+	resolver, kind, err := newDNSResolver(dnsURL)
+	if err != nil {
+		return nil, err
+	}
+	timed := &timedResolver{resolver, kind}
+	if cache.maxTTL <= 0 {
+		return timed, nil
+	}
+	return newCachingResolver(timed, kind, cache), nil
+}
+
+// newDNSResolver creates the resolver for a DNS server URL and returns its
+// type (udp, doh, dot or doq)
+func newDNSResolver(dnsURL string) (ttlResolver, string, error) {
+	// Check if it's a DoH URL
+	if strings.HasPrefix(dnsURL, "https://") {
+		resolver, err := newDoHResolver(dnsURL)
+		if err != nil {
+			return nil, "", err
+		}
+		return resolver, "doh", nil
+	}
+
+	// Check if it's DoQ (quic://), optionally falling back to DoT
+	// (quic://server?fallback=tls)
+	if strings.HasPrefix(dnsURL, "quic://") {
+		u, err := url.Parse(dnsURL)
+		if err != nil {
+			return nil, "", err
+		}
+		resolver, err := newDoQResolver(withDefaultPort(u.Host, "853"))
+		if err != nil {
+			return nil, "", err
+		}
+		switch fallback := u.Query().Get("fallback"); fallback {
+		case "":
+		case "tls":
+			if resolver.fallback, err = newDoTResolver(resolver.server); err != nil {
+				return nil, "", err
+			}
+		default:
+			return nil, "", fmt.Errorf("invalid DoQ fallback %q (supported: tls)", fallback)
+		}
+		return resolver, "doq", nil
+	}
+
+	// Check if it's DoT (tls://)
+	if strings.HasPrefix(dnsURL, "tls://") {
+		resolver, err := newDoTResolver(withDefaultPort(strings.TrimPrefix(dnsURL, "tls://"), "853"))
+		if err != nil {
+			return nil, "", err
+		}
+		return resolver, "dot", nil
+	}
+
+	// Standard DNS (udp:// or plain IP:port)
+	server := withDefaultPort(strings.TrimPrefix(dnsURL, "udp://"), "53")
+	return &StandardDNSResolver{server: server}, "udp", nil
+}
+
+// withDefaultPort adds port to a DNS server address without one. IPv6
+// addresses may be given with or without brackets.
+func withDefaultPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
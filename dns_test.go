@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testCert returns a self-signed certificate for 127.0.0.1 and localhost
+// and a pool trusting it
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goproxy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// Answers of testDNSReply
+var (
+	testIPv4 = net.ParseIP("192.0.2.1")
+	testIPv6 = net.ParseIP("2001:db8::1")
+)
+
+// testDNSReply answers a query like a DNS server knowing only example.com
+// (testIPv4 and testIPv6, TTL 300)
+func testDNSReply(q *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(q)
+	if len(q.Question) != 1 || q.Question[0].Name != "example.com." {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+	hdr := dns.RR_Header{Name: "example.com.", Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: testIPv4})
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: testIPv6})
+	}
+	return m
+}
+
+// checkTestAnswer checks the result of looking up example.com against a
+// server answering with testDNSReply
+func checkTestAnswer(t *testing.T, ips []net.IP, ttl time.Duration, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(testIPv4) || !ips[1].Equal(testIPv6) {
+		t.Errorf("lookup = %v, want [%v %v]", ips, testIPv4, testIPv6)
+	}
+	if ttl != 300*time.Second {
+		t.Errorf("TTL = %v, want 5m0s", ttl)
+	}
+}
+
+// dohServer is a DNS-over-HTTPS server answering with testDNSReply
+type dohServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	methods     []string
+	ids         []uint16 // message IDs of wire format queries
+	conns       int
+	contentType string // of wire format replies; dohMessageType if empty
+}
+
+func newDoHServer(t *testing.T) *dohServer {
+	s := &dohServer{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.EnableHTTP2 = true
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+		}
+	}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *dohServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	// JSON API
+	if name := r.URL.Query().Get("name"); name != "" {
+		s.mu.Lock()
+		s.methods = append(s.methods, "json")
+		s.mu.Unlock()
+		q := new(dns.Msg)
+		q.SetQuestion(dns.Fqdn(name), dns.StringToType[r.URL.Query().Get("type")])
+		reply := testDNSReply(q)
+		resp := map[string]any{"Status": reply.Rcode}
+		var answers []map[string]any
+		for _, rr := range reply.Answer {
+			var data string
+			switch rr := rr.(type) {
+			case *dns.A:
+				data = rr.A.String()
+			case *dns.AAAA:
+				data = rr.AAAA.String()
+			}
+			answers = append(answers, map[string]any{"type": rr.Header().Rrtype, "TTL": rr.Header().Ttl, "data": data})
+		}
+		resp["Answer"] = answers
+		w.Header().Set("Content-Type", "application/dns-json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	var query []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMessageType {
+			http.Error(w, "wrong content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(r.Body)
+	}
+	q := new(dns.Msg)
+	if err == nil {
+		err = q.Unpack(query)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.methods = append(s.methods, r.Method)
+	s.ids = append(s.ids, q.Id)
+	contentType := s.contentType
+	s.mu.Unlock()
+
+	reply, err := testDNSReply(q).Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if contentType == "" {
+		contentType = dohMessageType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(reply)
+}
+
+// newTestDoHResolver creates the resolver for the server s, using mode
+func newTestDoHResolver(t *testing.T, s *dohServer, mode string) *DoHResolver {
+	t.Helper()
+	r, err := newDoHResolver(s.URL + "/dns-query#" + mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	r.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+	return r
+}
+
+func TestDoH(t *testing.T) {
+	for _, tt := range []struct {
+		mode   string
+		method string
+	}{
+		{"", http.MethodGet},
+		{dohGet, http.MethodGet},
+		{dohPost, http.MethodPost},
+		{dohJSON, "json"},
+	} {
+		t.Run(tt.method+"#"+tt.mode, func(t *testing.T) {
+			s := newDoHServer(t)
+			r := newTestDoHResolver(t, s, tt.mode)
+			ctx := context.Background()
+
+			ips, ttl, err := r.lookupIPTTL(ctx, "example.com")
+			checkTestAnswer(t, ips, ttl, err)
+			s.mu.Lock()
+			conns := s.conns
+			s.mu.Unlock()
+			ips, ttl, err = r.lookupIPTTL(ctx, "example.com")
+			checkTestAnswer(t, ips, ttl, err)
+
+			// NXDOMAIN is reported as such
+			_, _, err = r.lookupIPTTL(ctx, "missing.example.com")
+			var rerr *rcodeError
+			if !errors.As(err, &rerr) || rerr.rcode != dns.RcodeNameError {
+				t.Errorf("lookup of a missing name: err = %v, want NXDOMAIN", err)
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if len(s.methods) != 6 {
+				t.Errorf("%d requests for 6 queries", len(s.methods))
+			}
+			for _, m := range s.methods {
+				if m != tt.method {
+					t.Errorf("%s request, want %s", m, tt.method)
+				}
+			}
+			for _, id := range s.ids {
+				if id != 0 {
+					t.Errorf("query with message ID %d, want 0", id)
+				}
+			}
+			// Later lookups are multiplexed over the HTTP/2 connection of
+			// the first one (whose concurrent A and AAAA requests may both
+			// dial)
+			if s.conns != conns {
+				t.Errorf("%d connections after the first lookup, %d in total", conns, s.conns)
+			}
+		})
+	}
+}
+
+func TestDoHContentType(t *testing.T) {
+	s := newDoHServer(t)
+	s.contentType = "text/html"
+	r := newTestDoHResolver(t, s, dohGet)
+	_, _, err := r.lookupIPTTL(context.Background(), "example.com")
+	if err == nil || !strings.Contains(err.Error(), "content type") {
+		t.Errorf("lookup with a text/html reply: err = %v, want a content type error", err)
+	}
+
+	if _, err := newDoHResolver(s.URL + "/dns-query#xml"); err == nil {
+		t.Errorf("unsupported DoH mode accepted")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults for the clamps of DNS cache TTLs
+const (
+	defaultDNSCacheMinTTL = 10 * time.Second
+	defaultDNSCacheMaxTTL = time.Hour
+)
+
+// dnsNegativeMaxTTL caps how long negative answers (see isNegativeAnswer)
+// are cached, so a host that is being set up is not missed for long
+const dnsNegativeMaxTTL = time.Minute
+
+// Prefetching of popular DNS cache entries: an entry looked up at least
+// dnsPrefetchMinHits times is refreshed in the background when it is hit
+// in the last dnsPrefetchWindow of its TTL (as a fraction), so lookups of
+// hosts in constant use never wait for the DNS server
+const (
+	dnsPrefetchMinHits = 3
+	dnsPrefetchWindow  = 0.1
+)
+
+// dnsLookupTimeout bounds the lookups of the cache, which are shared by
+// concurrent callers or run in the background
+const dnsLookupTimeout = 10 * time.Second
+
+// dnsCacheConfig holds the clamps of DNS cache TTLs. A zero maxTTL disables
+// the cache.
+type dnsCacheConfig struct {
+	minTTL time.Duration
+	maxTTL time.Duration
+}
+
+// dnsCacheEntry is a cached answer, either addresses or a negative answer
+type dnsCacheEntry struct {
+	ips        []net.IP
+	err        error // a negative answer
+	ttl        time.Duration
+	expires    time.Time
+	hits       int  // lookups answered by this entry
+	refreshing bool // a prefetch is in progress
+}
+
+// cachingResolver caches the answers of a resolver for their TTL, clamped
+// to the configured bounds. Concurrent lookups of the same host are
+// coalesced into one query.
+type cachingResolver struct {
+	resolver ttlResolver
+	kind     string // resolver type, for metrics
+	config   dnsCacheConfig
+
+	mu        sync.Mutex
+	entries   map[string]*dnsCacheEntry // lower-case host -> answer
+	lastSweep time.Time
+	flights   singleflight.Group
+}
+
+// newCachingResolver wraps resolver, whose type is kind, in a cache
+func newCachingResolver(resolver ttlResolver, kind string, config dnsCacheConfig) *cachingResolver {
+	return &cachingResolver{
+		resolver:  resolver,
+		kind:      kind,
+		config:    config,
+		entries:   make(map[string]*dnsCacheEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *cachingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	key := strings.ToLower(host)
+	now := time.Now()
+
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && now.Before(e.expires) {
+		e.hits++
+		prefetch := !e.refreshing && e.hits >= dnsPrefetchMinHits &&
+			e.expires.Sub(now) < time.Duration(float64(e.ttl)*dnsPrefetchWindow)
+		if prefetch {
+			e.refreshing = true
+		}
+		ips, err := e.ips, e.err
+		c.mu.Unlock()
+
+		dnsCacheHits.WithLabelValues(c.kind).Inc()
+		if prefetch {
+			dnsCachePrefetches.WithLabelValues(c.kind).Inc()
+			go c.prefetch(key, host)
+		}
+		return append([]net.IP(nil), ips...), err
+	}
+	c.mu.Unlock()
+
+	dnsCacheMisses.WithLabelValues(c.kind).Inc()
+	v, err, _ := c.flights.Do(key, func() (interface{}, error) {
+		// The lookup is shared by every caller waiting for host, so it must
+		// not fail because the first one gave up
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), dnsLookupTimeout)
+		defer cancel()
+		return c.resolve(ctx, key, host)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]net.IP(nil), v.([]net.IP)...), nil
+}
+
+// resolve looks host up and caches the answer under key, unless the lookup
+// failed for another reason than a negative answer
+func (c *cachingResolver) resolve(ctx context.Context, key, host string) ([]net.IP, error) {
+	ips, ttl, err := c.resolver.lookupIPTTL(ctx, host)
+	if err == nil || isNegativeAnswer(err) {
+		c.store(key, &dnsCacheEntry{ips: ips, err: err, ttl: c.clamp(ttl, err != nil)})
+	}
+	return ips, err
+}
+
+// prefetch refreshes the entry of host in the background. If that fails,
+// the entry is kept until it expires.
+func (c *cachingResolver) prefetch(key, host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	_, err, _ := c.flights.Do(key, func() (interface{}, error) {
+		return c.resolve(ctx, key, host)
+	})
+	if err != nil && !isNegativeAnswer(err) {
+		slog.Debug("DNS prefetch failed", "host", host, "err", err)
+		c.mu.Lock()
+		if e := c.entries[key]; e != nil {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// clamp bounds the TTL of an answer by the cache configuration, and that of
+// negative answers also by dnsNegativeMaxTTL
+func (c *cachingResolver) clamp(ttl time.Duration, negative bool) time.Duration {
+	maxTTL := c.config.maxTTL
+	if negative {
+		maxTTL = min(maxTTL, dnsNegativeMaxTTL)
+	}
+	return min(max(ttl, c.config.minTTL), maxTTL)
+}
+
+// store caches an entry and drops expired ones every maxTTL, so hosts that
+// are no longer looked up do not pile up
+func (c *cachingResolver) store(key string, e *dnsCacheEntry) {
+	now := time.Now()
+	e.expires = now.Add(e.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+	if now.Sub(c.lastSweep) < c.config.maxTTL {
+		return
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.lastSweep = now
+}
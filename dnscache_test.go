@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeTTLResolver answers every lookup with ips, ttl and err
+type fakeTTLResolver struct {
+	mu      sync.Mutex
+	ips     []net.IP
+	ttl     time.Duration
+	err     error
+	lookups int
+	// started, if not nil, is closed by the first lookup, which then waits
+	// for release
+	started chan struct{}
+	release chan struct{}
+	ctxErr  error // of the context of the last lookup, once it returned
+}
+
+func (r *fakeTTLResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	r.lookups++
+	started := r.started
+	r.started = nil
+	r.mu.Unlock()
+	if started != nil {
+		close(started)
+		<-r.release
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctxErr = ctx.Err()
+	return r.ips, r.ttl, r.err
+}
+
+// count returns the number of lookups
+func (r *fakeTTLResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// newTestCachingResolver caches the answers of r with the default clamps
+func newTestCachingResolver(r *fakeTTLResolver) *cachingResolver {
+	return newCachingResolver(r, "test", dnsCacheConfig{minTTL: defaultDNSCacheMinTTL, maxTTL: defaultDNSCacheMaxTTL})
+}
+
+// dnsCacheCounter returns a function counting the cache hits, misses and
+// prefetches of c since dnsCacheCounter was called
+func dnsCacheCounter(c *cachingResolver) func() (hits, misses, prefetches float64) {
+	counts := func() (hits, misses, prefetches float64) {
+		return testutil.ToFloat64(dnsCacheHits.WithLabelValues(c.kind)),
+			testutil.ToFloat64(dnsCacheMisses.WithLabelValues(c.kind)),
+			testutil.ToFloat64(dnsCachePrefetches.WithLabelValues(c.kind))
+	}
+	hits0, misses0, prefetches0 := counts()
+	return func() (hits, misses, prefetches float64) {
+		hits, misses, prefetches = counts()
+		return hits - hits0, misses - misses0, prefetches - prefetches0
+	}
+}
+
+func TestDNSCacheClamp(t *testing.T) {
+	c := newTestCachingResolver(&fakeTTLResolver{})
+	for _, tt := range []struct {
+		ttl      time.Duration
+		negative bool
+		want     time.Duration
+	}{
+		{0, false, defaultDNSCacheMinTTL},
+		{time.Second, false, defaultDNSCacheMinTTL},
+		{5 * time.Minute, false, 5 * time.Minute},
+		{24 * time.Hour, false, defaultDNSCacheMaxTTL},
+		{0, true, defaultDNSCacheMinTTL},
+		{30 * time.Second, true, 30 * time.Second},
+		{5 * time.Minute, true, dnsNegativeMaxTTL},
+	} {
+		if got := c.clamp(tt.ttl, tt.negative); got != tt.want {
+			t.Errorf("clamp(%v, negative %v) = %v, want %v", tt.ttl, tt.negative, got, tt.want)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	r := &fakeTTLResolver{ips: []net.IP{testIPv4}, ttl: 24 * time.Hour}
+	c := newTestCachingResolver(r)
+	counts := dnsCacheCounter(c)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		ips, err := c.LookupIP(ctx, "Example.com")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(testIPv4) {
+			t.Fatalf("lookup = %v, %v", ips, err)
+		}
+	}
+	if n := r.count(); n != 1 {
+		t.Errorf("%d lookups for 3 cached ones, want 1", n)
+	}
+	if hits, misses, _ := counts(); hits != 2 || misses != 1 {
+		t.Errorf("%v hits and %v misses, want 2 and 1", hits, misses)
+	}
+
+	// The TTL is clamped, and the expired entry looked up again
+	c.mu.Lock()
+	e := c.entries["example.com"]
+	if e.ttl != defaultDNSCacheMaxTTL {
+		t.Errorf("entry cached for %v, want %v", e.ttl, defaultDNSCacheMaxTTL)
+	}
+	e.expires = time.Now()
+	c.mu.Unlock()
+	c.LookupIP(ctx, "example.com")
+	if n := r.count(); n != 2 {
+		t.Errorf("%d lookups after the entry expired, want 2", n)
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	r := &fakeTTLResolver{ttl: time.Hour, err: &rcodeError{host: "example.com", rcode: dns.RcodeNameError}}
+	c := newTestCachingResolver(r)
+	ctx := context.Background()
+
+	// NXDOMAIN is cached, for at most dnsNegativeMaxTTL
+	for i := 0; i < 2; i++ {
+		var rerr *rcodeError
+		if _, err := c.LookupIP(ctx, "example.com"); !errors.As(err, &rerr) {
+			t.Fatalf("lookup: err = %v, want NXDOMAIN", err)
+		}
+	}
+	if n := r.count(); n != 1 {
+		t.Errorf("%d lookups of a missing name, want 1", n)
+	}
+	c.mu.Lock()
+	if ttl := c.entries["example.com"].ttl; ttl != dnsNegativeMaxTTL {
+		t.Errorf("negative answer cached for %v, want %v", ttl, dnsNegativeMaxTTL)
+	}
+	c.mu.Unlock()
+
+	// Failures are not
+	r.mu.Lock()
+	r.err = errors.New("timeout")
+	r.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupIP(ctx, "other.example.com"); err == nil {
+			t.Fatalf("failed lookup succeeded")
+		}
+	}
+	if n := r.count(); n != 3 {
+		t.Errorf("%d lookups, want 3: failures must not be cached", n)
+	}
+}
+
+func TestDNSCachePrefetch(t *testing.T) {
+	r := &fakeTTLResolver{ips: []net.IP{testIPv4}, ttl: 100 * time.Second}
+	c := newTestCachingResolver(r)
+	counts := dnsCacheCounter(c)
+	ctx := context.Background()
+
+	// Hits outside the prefetch window, then the third hit inside it
+	c.LookupIP(ctx, "example.com")
+	c.LookupIP(ctx, "example.com")
+	c.LookupIP(ctx, "example.com")
+	if _, _, prefetches := counts(); prefetches != 0 {
+		t.Errorf("prefetch outside the window")
+	}
+	c.mu.Lock()
+	c.entries["example.com"].expires = time.Now().Add(5 * time.Second)
+	c.mu.Unlock()
+	if ips, err := c.LookupIP(ctx, "example.com"); err != nil || len(ips) != 1 {
+		t.Fatalf("lookup = %v, %v", ips, err)
+	}
+
+	// The entry is refreshed in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		e := c.entries["example.com"]
+		refreshed := e.hits == 0 && time.Until(e.expires) > 90*time.Second
+		c.mu.Unlock()
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := r.count(); n != 2 {
+		t.Errorf("%d lookups, want 2", n)
+	}
+	if hits, misses, prefetches := counts(); hits != 3 || misses != 1 || prefetches != 1 {
+		t.Errorf("%v hits, %v misses and %v prefetches, want 3, 1 and 1", hits, misses, prefetches)
+	}
+}
+
+func TestDNSCacheCancel(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	r := &fakeTTLResolver{ips: []net.IP{testIPv4}, ttl: time.Minute, started: started, release: release}
+	c := newTestCachingResolver(r)
+
+	// The caller starting the shared lookup gives up while it is in
+	// progress, which must not fail it for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := c.LookupIP(ctx, "example.com")
+		done <- err
+	}()
+	<-started
+	cancel()
+	close(release)
+	<-done
+	r.mu.Lock()
+	if r.ctxErr != nil {
+		t.Errorf("shared lookup ran with a context ending with its first caller: %v", r.ctxErr)
+	}
+	r.mu.Unlock()
+	if ips, err := c.LookupIP(context.Background(), "example.com"); err != nil || len(ips) != 1 {
+		t.Errorf("lookup = %v, %v", ips, err)
+	}
+	if n := r.count(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
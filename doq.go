@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DNS-over-QUIC protocol constants (RFC 9250)
+const (
+	doqALPN             = "doq"
+	doqRequestCancelled = 0x3 // DOQ_REQUEST_CANCELLED
+)
+
+// doqIdleTimeout is how long an unused DoQ connection is kept open
+const doqIdleTimeout = 30 * time.Second
+
+// doqHandshakeTimeout bounds dialing a DoQ server. UDP may be silently
+// dropped, and this leaves the fallback time to answer.
+const doqHandshakeTimeout = 2 * time.Second
+
+// DoQResolver uses DNS-over-QUIC (RFC 9250). Every query is sent on its own
+// stream of a QUIC connection shared by all lookups, which is dialed again
+// once it fails or idles out. With a fallback, lookups that fail for any
+// reason but a DNS answer (such as NXDOMAIN) are retried with it; that is
+// only done when explicitly configured, since QUIC is often chosen because
+// TCP port 853 is blocked.
+type DoQResolver struct {
+	server   string
+	tls      *tls.Config
+	fallback ttlResolver // nil unless configured with quic://...?fallback=tls
+
+	mu   sync.Mutex
+	conn quic.Connection // nil until the first lookup
+}
+
+// doqConn is the QUIC connection of a DoQResolver
+type doqConn struct {
+	quic.Connection
+}
+
+func (c doqConn) closed() bool {
+	return c.Context().Err() != nil
+}
+
+// newDoQResolver creates a DoQ resolver for the server host:port
+func newDoQResolver(server string) (*DoQResolver, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	return &DoQResolver{
+		server: server,
+		tls: &tls.Config{
+			ServerName: host,
+			NextProtos: []string{doqALPN},
+			MinVersion: tls.VersionTLS13,
+		},
+	}, nil
+}
+
+func (r *DoQResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ips, ttl, err := r.resolve(ctx, host)
+	var rerr *rcodeError
+	var nerr *noAddressesError
+	if err != nil && r.fallback != nil && !errors.As(err, &rerr) && !errors.As(err, &nerr) && ctx.Err() == nil {
+		logger(ctx).Warn("DoQ lookup failed; falling back to DoT", "server", r.server, "host", host, "err", err)
+		return r.fallback.lookupIPTTL(ctx, host)
+	}
+	return ips, ttl, err
+}
+
+// resolve dials the connection before querying A and AAAA records on it, so
+// that an unreachable server is only waited for once
+func (r *DoQResolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if _, _, err := r.connection(ctx); err != nil {
+		return nil, 0, err
+	}
+	return lookupBoth(ctx, host, r.lookup)
+}
+
+// lookup queries one record type of host
+func (r *DoQResolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), qtype)
+	m.Id = 0 // the stream identifies the query (RFC 9250, section 4.2.1)
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reply, err := exchangeShared(ctx, r.connection, func(conn doqConn) (*dns.Msg, error) {
+		return r.exchange(ctx, conn, query)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return answerIPs(reply, host, qtype)
+}
+
+// exchange sends a packed query on a new stream of conn and reads the reply
+func (r *DoQResolver) exchange(ctx context.Context, conn doqConn, query []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	})
+	defer stop()
+
+	// Messages carry a two byte length prefix, like DNS over TCP. Each side
+	// closes its direction of the stream after its message.
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := stream.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, fmt.Errorf("malformed DoQ response from %s", r.server)
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data[2:]); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// connection returns the shared QUIC connection, dialing it if there is
+// none or it was closed. reused reports whether it was dialed earlier.
+func (r *DoQResolver) connection(ctx context.Context) (conn doqConn, reused bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil && r.conn.Context().Err() == nil {
+		return doqConn{r.conn}, true, nil
+	}
+	c, err := quic.DialAddr(ctx, r.server, r.tls, &quic.Config{
+		HandshakeIdleTimeout: doqHandshakeTimeout,
+		MaxIdleTimeout:       doqIdleTimeout,
+	})
+	if err != nil {
+		return doqConn{}, false, err
+	}
+	r.conn = c
+	return doqConn{c}, false, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqServer is a DNS-over-QUIC server answering with testDNSReply
+type doqServer struct {
+	ln *quic.Listener
+
+	mu      sync.Mutex
+	conns   []quic.Connection
+	streams int
+	ids     []uint16 // message IDs of the queries
+}
+
+// newDoQServer starts a DoQ server on addr offering the ALPN protocol alpn
+func newDoQServer(t *testing.T, addr, alpn string, cert tls.Certificate) *doqServer {
+	t.Helper()
+	ln, err := quic.ListenAddr(addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{alpn},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &doqServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serveConn(conn)
+		}
+	}()
+	return s
+}
+
+func (s *doqServer) serveConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveStream(stream)
+	}
+}
+
+// serveStream answers the one query sent on stream
+func (s *doqServer) serveStream(stream quic.Stream) {
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil || len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(data[2:]); err != nil {
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	s.mu.Lock()
+	s.streams++
+	s.ids = append(s.ids, q.Id)
+	s.mu.Unlock()
+
+	reply, err := testDNSReply(q).Pack()
+	if err != nil {
+		stream.CancelWrite(doqRequestCancelled)
+		return
+	}
+	msg := make([]byte, 2+len(reply))
+	binary.BigEndian.PutUint16(msg, uint16(len(reply)))
+	copy(msg[2:], reply)
+	stream.Write(msg)
+}
+
+// closeConns closes all connections, as after they idled out
+func (s *doqServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.CloseWithError(0, "idle")
+	}
+}
+
+// counts returns the number of connections and streams the server accepted
+func (s *doqServer) counts() (conns, streams int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), s.streams
+}
+
+// newTestDoQResolver creates the resolver for dnsURL, trusting roots for
+// DoQ and its DoT fallback
+func newTestDoQResolver(t *testing.T, dnsURL string, roots *x509.CertPool) *DoQResolver {
+	t.Helper()
+	resolver, kind, err := newDNSResolver(dnsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := resolver.(*DoQResolver)
+	if !ok || kind != "doq" {
+		t.Fatalf("newDNSResolver(%q) = %T %s, want a DoQ resolver", dnsURL, resolver, kind)
+	}
+	r.tls.RootCAs = roots
+	if r.fallback != nil {
+		r.fallback.(*DoTResolver).tls.RootCAs = roots
+	}
+	return r
+}
+
+func TestDoQ(t *testing.T) {
+	cert, roots := testCert(t)
+	s := newDoQServer(t, "127.0.0.1:0", doqALPN, cert)
+	r := newTestDoQResolver(t, "quic://"+s.ln.Addr().String(), roots)
+	ctx := context.Background()
+
+	// Both lookups share one connection, with a stream per query
+	for i := 0; i < 2; i++ {
+		ips, ttl, err := r.lookupIPTTL(ctx, "example.com")
+		checkTestAnswer(t, ips, ttl, err)
+	}
+	if conns, streams := s.counts(); conns != 1 || streams != 4 {
+		t.Errorf("%d connections and %d streams for 4 queries, want 1 and 4", conns, streams)
+	}
+	s.mu.Lock()
+	for _, id := range s.ids {
+		if id != 0 {
+			t.Errorf("query with message ID %d, want 0", id)
+		}
+	}
+	s.mu.Unlock()
+
+	// NXDOMAIN is an answer, not a failure of the server
+	_, _, err := r.lookupIPTTL(ctx, "missing.example.com")
+	var rerr *rcodeError
+	if !errors.As(err, &rerr) || rerr.rcode != dns.RcodeNameError {
+		t.Errorf("lookup of a missing name: err = %v, want NXDOMAIN", err)
+	}
+}
+
+func TestDoQReconnect(t *testing.T) {
+	cert, roots := testCert(t)
+	s := newDoQServer(t, "127.0.0.1:0", doqALPN, cert)
+	r := newTestDoQResolver(t, "quic://"+s.ln.Addr().String(), roots)
+	ctx := context.Background()
+
+	ips, ttl, err := r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+
+	// Once the server dropped the idle connection, the next lookup dials a
+	// new one
+	s.closeConns()
+	ips, ttl, err = r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+	ips, ttl, err = r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+	if conns, _ := s.counts(); conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+}
+
+func TestDoQFallback(t *testing.T) {
+	cert, roots := testCert(t)
+
+	// A DoT server, and on the same port a QUIC server that does not speak
+	// DoQ, so that every DoQ handshake fails
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int
+	var mu sync.Mutex
+	dot := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+		w.WriteMsg(testDNSReply(q))
+	})}
+	go dot.ActivateAndServe()
+	t.Cleanup(func() { dot.Shutdown() })
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	newDoQServer(t, "127.0.0.1:"+port, "h3", cert)
+	ctx := context.Background()
+
+	// Without ?fallback=tls the DoQ failure is returned
+	r := newTestDoQResolver(t, "quic://127.0.0.1:"+port, roots)
+	if r.fallback != nil {
+		t.Fatalf("fallback configured without ?fallback=tls")
+	}
+	if _, _, err := r.lookupIPTTL(ctx, "example.com"); err == nil {
+		t.Errorf("lookup succeeded with a server that does not speak DoQ")
+	}
+	mu.Lock()
+	if queries != 0 {
+		t.Errorf("%d queries fell back to DoT without ?fallback=tls", queries)
+	}
+	mu.Unlock()
+
+	r = newTestDoQResolver(t, "quic://127.0.0.1:"+port+"?fallback=tls", roots)
+	ips, ttl, err := r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+	mu.Lock()
+	if queries != 2 {
+		t.Errorf("%d queries sent over DoT, want 2", queries)
+	}
+	mu.Unlock()
+
+	if _, _, err := newDNSResolver("quic://127.0.0.1:" + port + "?fallback=udp"); err == nil {
+		t.Errorf("unsupported fallback accepted")
+	}
+}
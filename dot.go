@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS-over-TLS connection timeouts
+const (
+	dotDialTimeout = 5 * time.Second
+	dotIdleTimeout = 30 * time.Second // how long an unused connection is kept open
+	// dotReadTimeout is how long the server may take to answer a query
+	// before its connection is considered broken and closed
+	dotReadTimeout = 5 * time.Second
+)
+
+// DoTResolver uses DNS-over-TLS (RFC 7858). Queries are pipelined over one
+// persistent TLS connection and their replies, which may come back in any
+// order, are matched by message ID (RFC 7766, section 6.2.1.1). The
+// connection is closed after dotIdleTimeout without queries and dialed
+// again by the next lookup, or right away if it fails.
+type DoTResolver struct {
+	server string
+	tls    *tls.Config
+
+	mu   sync.Mutex
+	conn *dotConn // nil until the first lookup
+}
+
+// newDoTResolver creates a DoT resolver for the server host:port
+func newDoTResolver(server string) (*DoTResolver, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	return &DoTResolver{
+		server: server,
+		tls:    &tls.Config{ServerName: host},
+	}, nil
+}
+
+// lookupIPTTL dials the connection before querying A and AAAA records on
+// it, so that both queries share it
+func (r *DoTResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if _, _, err := r.connection(ctx); err != nil {
+		return nil, 0, err
+	}
+	return lookupBoth(ctx, host, r.lookup)
+}
+
+// lookup queries one record type of host
+func (r *DoTResolver) lookup(ctx context.Context, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), qtype)
+	reply, err := exchangeShared(ctx, r.connection, func(conn *dotConn) (*dns.Msg, error) {
+		return conn.exchange(ctx, m)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return answerIPs(reply, host, qtype)
+}
+
+// connection returns the shared connection, dialing it if there is none or
+// it was closed. reused reports whether it was dialed earlier.
+func (r *DoTResolver) connection(ctx context.Context) (conn *dotConn, reused bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil && !r.conn.closed() {
+		return r.conn, true, nil
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: dotDialTimeout},
+		Config:    r.tls,
+	}
+	c, err := dialer.DialContext(ctx, "tcp", r.server)
+	if err != nil {
+		return nil, false, err
+	}
+	r.conn = newDotConn(r.server, c)
+	return r.conn, false, nil
+}
+
+// dotConn is a DoT connection shared by concurrent queries. A goroutine
+// reads the replies and hands them to the queries waiting for them.
+type dotConn struct {
+	server string
+	conn   *dns.Conn
+
+	writeMu sync.Mutex // serializes queries on the connection
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg // message ID -> query waiting for the reply
+	err     error                    // why the connection was closed
+	done    chan struct{}            // closed with the connection
+}
+
+// newDotConn starts reading replies from a connection to server
+func newDotConn(server string, conn net.Conn) *dotConn {
+	c := &dotConn{
+		server:  server,
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	c.conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+	go c.readReplies()
+	return c
+}
+
+// exchange sends m with an unused message ID and waits for the reply
+func (c *dotConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	reply := make(chan *dns.Msg, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	for {
+		m.Id = dns.Id()
+		if _, ok := c.pending[m.Id]; !ok {
+			break
+		}
+	}
+	id := m.Id
+	c.pending[id] = reply
+	c.conn.SetReadDeadline(time.Now().Add(dotReadTimeout))
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dotReadTimeout)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	err := c.conn.WriteMsg(m)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, c.err
+	}
+
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readReplies delivers replies to the queries waiting for them until the
+// connection fails, the server does not answer within dotReadTimeout, or
+// it is idle for dotIdleTimeout
+func (c *dotConn) readReplies() {
+	for {
+		m, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.mu.Lock()
+		reply, ok := c.pending[m.Id]
+		delete(c.pending, m.Id)
+		if len(c.pending) == 0 {
+			c.conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(dotReadTimeout))
+		}
+		c.mu.Unlock()
+		if ok {
+			reply <- m // buffered, and deleted above so it is only sent once
+		}
+	}
+}
+
+// close closes the connection because of err, failing pending queries
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = fmt.Errorf("DoT connection to %s closed: %w", c.server, err)
+		close(c.done)
+		c.conn.Close()
+	}
+}
+
+// closed reports whether the connection was closed
+func (c *dotConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
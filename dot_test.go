@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotServer is a DNS-over-TLS server answering with testDNSReply
+type dotServer struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	queries int
+	// batch holds replies back until this many queries are waiting on a
+	// connection, then sends them in reverse order
+	batch int
+	// drop closes the connection on the next query instead of answering it
+	drop bool
+}
+
+func newDoTServer(t *testing.T, cert tls.Certificate) *dotServer {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dotServer{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		s.closeConns()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serveConn(conn)
+		}
+	}()
+	return s
+}
+
+func (s *dotServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := &dns.Conn{Conn: conn}
+	var held []*dns.Msg
+	for {
+		q, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.queries++
+		drop, batch := s.drop, s.batch
+		s.drop = false
+		s.mu.Unlock()
+		if drop {
+			return
+		}
+		held = append(held, testDNSReply(q))
+		if len(held) < batch {
+			continue
+		}
+		for i := len(held) - 1; i >= 0; i-- {
+			if err := c.WriteMsg(held[i]); err != nil {
+				return
+			}
+		}
+		held = nil
+	}
+}
+
+// closeConns closes all connections, as after they idled out
+func (s *dotServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// counts returns the number of connections and queries the server accepted
+func (s *dotServer) counts() (conns, queries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), s.queries
+}
+
+// newTestDoTResolver creates the resolver for the server s
+func newTestDoTResolver(t *testing.T, s *dotServer, roots *x509.CertPool) *DoTResolver {
+	t.Helper()
+	r, err := newDoTResolver(s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.tls.RootCAs = roots
+	return r
+}
+
+func TestDoTPipelining(t *testing.T) {
+	cert, roots := testCert(t)
+	s := newDoTServer(t, cert)
+	r := newTestDoTResolver(t, s, roots)
+
+	// The replies to the 8 queries of 4 concurrent lookups only come once
+	// all of them were sent, last query first
+	const lookups = 4
+	s.batch = 2 * lookups
+	var wg sync.WaitGroup
+	ips := make([][]net.IP, lookups)
+	ttls := make([]time.Duration, lookups)
+	errs := make([]error, lookups)
+	for i := 0; i < lookups; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips[i], ttls[i], errs[i] = r.lookupIPTTL(context.Background(), "example.com")
+		}()
+	}
+	wg.Wait()
+	for i := range ips {
+		checkTestAnswer(t, ips[i], ttls[i], errs[i])
+	}
+	if conns, queries := s.counts(); conns != 1 || queries != 2*lookups {
+		t.Errorf("%d connections and %d queries for %d lookups, want 1 and %d", conns, queries, lookups, 2*lookups)
+	}
+}
+
+func TestDoTReconnect(t *testing.T) {
+	cert, roots := testCert(t)
+	s := newDoTServer(t, cert)
+	r := newTestDoTResolver(t, s, roots)
+	ctx := context.Background()
+
+	ips, ttl, err := r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+
+	// Once the server dropped the idle connection, the next lookup dials a
+	// new one
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	s.closeConns()
+	select {
+	case <-conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closed connection not noticed")
+	}
+	ips, ttl, err = r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+	ips, ttl, err = r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+	if conns, _ := s.counts(); conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+}
+
+func TestDoTRetry(t *testing.T) {
+	cert, roots := testCert(t)
+	s := newDoTServer(t, cert)
+	r := newTestDoTResolver(t, s, roots)
+	ctx := context.Background()
+
+	ips, ttl, err := r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+
+	// The server closes the reused connection while a query is waiting for
+	// its reply, so the query is sent again on a new connection
+	s.mu.Lock()
+	s.drop = true
+	s.mu.Unlock()
+	ips, ttl, err = r.lookupIPTTL(ctx, "example.com")
+	checkTestAnswer(t, ips, ttl, err)
+	if conns, _ := s.counts(); conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+
+	// A query failing on a new connection is not retried
+	s.mu.Lock()
+	s.drop = true
+	s.mu.Unlock()
+	s.closeConns()
+	r.mu.Lock()
+	r.conn.close(net.ErrClosed)
+	r.mu.Unlock()
+	if _, _, err := r.lookup(ctx, "example.com", dns.TypeA); err == nil {
+		t.Errorf("query answered by a server closing the connection")
+	}
+	if conns, _ := s.counts(); conns != 3 {
+		t.Errorf("%d connections, want 3", conns)
+	}
+}
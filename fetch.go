@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// zipFetchTimeout bounds a single upstream zip download
+const zipFetchTimeout = 10 * time.Minute
+
+// zipServeTimeout bounds sending a zip to a client once it is in the cache.
+// It replaces the server's WriteTimeout after a download, which already used
+// up part of it.
+const zipServeTimeout = 10 * time.Minute
+
+// zipDownloadAttempts bounds how often a zip is downloaded for one request
+// when it is purged or evicted before it could be served
+const zipDownloadAttempts = 3
+
+// upstreamError reports a non-200 response from upstream
+type upstreamError struct {
+	url    string
+	status int
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream returned %d for %s", e.status, e.url)
+}
+
+// errOffline is returned instead of contacting upstream in offline mode
+var errOffline = errors.New("not in cache (offline mode)")
+
+// errorStatus maps a fetch error to the status code returned to the client.
+// Upstream status codes are passed through so that 404/410 keep their meaning
+// for the go command; anything else is reported as 502.
+func errorStatus(err error) int {
+	var uerr *upstreamError
+	if errors.As(err, &uerr) {
+		return uerr.status
+	}
+	if errors.Is(err, errOffline) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadGateway
+}
+
+// isNotFound reports whether err is an upstream 404 or 410
+func isNotFound(err error) bool {
+	status := errorStatus(err)
+	return status == http.StatusNotFound || status == http.StatusGone
+}
+
+// fetchUpstream fetches a small artifact of modPath from upstream into memory
+func (p *Proxy) fetchUpstream(ctx context.Context, modPath, path string) ([]byte, error) {
+	resp, err := p.openUpstream(ctx, modPath, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// coalesce runs fn for key through p.flights, so concurrent callers share
+// one call. Callers that waited for another caller's fn are marked as
+// coalesced; the one that ran it is not, even though singleflight reports
+// the result as shared to it too.
+func (p *Proxy) coalesce(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	ran := false
+	v, err, _ := p.flights.Do(key, func() (interface{}, error) {
+		ran = true // only the caller running fn sees this
+		return fn()
+	})
+	if !ran {
+		markCoalesced(ctx, key)
+	}
+	return v, err
+}
+
+// fetchAndCache fetches the small artifact of mreq from upstream, validates
+// it and, if cacheable, writes it to the cache. Concurrent calls for the same
+// key share a single upstream request; the fetch is detached from the calling
+// request so one client going away does not fail the others waiting on it.
+func (p *Proxy) fetchAndCache(ctx context.Context, mreq *moduleRequest, cacheable bool, validate func([]byte) error) ([]byte, error) {
+	key := mreq.Key()
+	v, err := p.coalesce(ctx, key, func() (interface{}, error) {
+		// A fetch that finished after the caller missed the cache, but
+		// before this one started, may have cached the artifact already
+		if cacheable {
+			unlock := p.locks.RLock(key)
+			data, err := p.readCache(ctx, key)
+			unlock()
+			if err == nil {
+				return data, nil
+			}
+		}
+
+		inFlight := downloadsInFlight.WithLabelValues(mreq.Kind.String())
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		ctx := context.WithoutCancel(ctx)
+		data, err := p.fetchUpstream(ctx, mreq.Module, key)
+		if err != nil {
+			return nil, err
+		}
+		if validate != nil {
+			if err := validate(data); err != nil {
+				return nil, err
+			}
+		}
+
+		// Cache the response (write lock)
+		if cacheable {
+			unlock := p.locks.Lock(key)
+			if err := p.writeCache(ctx, key, data); err != nil {
+				logger(ctx).Warn("Failed to cache", "key", key, "err", err)
+			}
+			unlock()
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// mutableFetch is the result of a coalesced fetch of a mutable entry
+type mutableFetch struct {
+	data        []byte
+	revalidated bool // upstream confirmed the cached copy (304)
+}
+
+// fetchMutable returns a mutable entry (list or @latest). A cached copy
+// fetched less than maxAge (normally the list TTL) ago is served as is.
+// Older copies are revalidated with upstream using the stored
+// ETag/Last-Modified validators, and are still served if upstream fails with
+// anything but 404/410 (stale-if-error). It also returns how the entry was
+// obtained: cacheHit, cacheMiss or cacheRefresh (fetched from upstream),
+// cacheRevalidated or cacheStale, also when the upstream request was shared
+// with another caller.
+func (p *Proxy) fetchMutable(ctx context.Context, mreq *moduleRequest, maxAge time.Duration, validate func([]byte) error) ([]byte, string, error) {
+	key := mreq.Key()
+
+	// Try cache first (read lock)
+	unlock := p.locks.RLock(key)
+	cached, err := p.readCache(ctx, key)
+	meta := p.readCacheMeta(ctx, key)
+	if err == nil && meta.Fetched.IsZero() {
+		// Entries cached before fetch times were recorded
+		if info, err := p.storage.Stat(ctx, key); err == nil {
+			meta.Fetched = info.ModTime
+		}
+	}
+	unlock()
+
+	if err == nil && time.Since(meta.Fetched) < maxAge {
+		cacheResult(ctx, mreq.Kind.String(), key, cacheHit)
+		servedBytes.WithLabelValues(sourceCache).Add(float64(len(cached)))
+		return cached, cacheHit, nil
+	}
+	status := cacheRefresh
+	if err != nil {
+		cached = nil
+		status = cacheMiss
+	}
+	cacheResult(ctx, mreq.Kind.String(), key, status)
+
+	v, err := p.coalesce(ctx, key, func() (interface{}, error) {
+		inFlight := downloadsInFlight.WithLabelValues(mreq.Kind.String())
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		ctx := context.WithoutCancel(ctx)
+		header := http.Header{}
+		if cached != nil {
+			if meta.ETag != "" {
+				header.Set("If-None-Match", meta.ETag)
+			}
+			if meta.LastModified != "" {
+				header.Set("If-Modified-Since", meta.LastModified)
+			}
+		}
+
+		resp, err := p.openUpstream(ctx, mreq.Module, key, header)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		// Still current: restart the TTL on the cached copy
+		if resp.StatusCode == http.StatusNotModified {
+			logger(ctx).Debug("Revalidated, not modified", "key", key)
+			meta.Fetched = time.Now()
+			unlock := p.locks.Lock(key)
+			if err := p.writeCacheMeta(ctx, key, meta); err != nil {
+				logger(ctx).Warn("Failed to refresh", "key", key, "err", err)
+			}
+			unlock()
+			return mutableFetch{data: cached, revalidated: true}, nil
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if validate != nil {
+			if err := validate(data); err != nil {
+				return nil, err
+			}
+		}
+
+		// Cache the response and its validators (write lock)
+		unlock := p.locks.Lock(key)
+		if err := p.writeCache(ctx, key, data); err != nil {
+			logger(ctx).Warn("Failed to cache", "key", key, "err", err)
+		}
+		meta := cacheMeta{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Fetched:      time.Now(),
+		}
+		if err := p.writeCacheMeta(ctx, key, meta); err != nil {
+			logger(ctx).Warn("Failed to cache validators", "key", key, "err", err)
+		}
+		unlock()
+		return mutableFetch{data: data}, nil
+	})
+	if err == nil {
+		res := v.(mutableFetch)
+		if res.revalidated {
+			status = cacheRevalidated
+			accessFrom(ctx).cache = status
+		}
+		servedBytes.WithLabelValues(sourceUpstream).Add(float64(len(res.data)))
+		return res.data, status, nil
+	}
+
+	// Serve the stale copy unless upstream says the module is gone
+	if cached != nil && !isNotFound(err) {
+		accessFrom(ctx).cache = cacheStale
+		logger(ctx).Warn("Serving stale copy after upstream error", "key", key, "err", err)
+		servedBytes.WithLabelValues(sourceCache).Add(float64(len(cached)))
+		return cached, cacheStale, nil
+	}
+	return nil, status, err
+}
+
+// downloadZip downloads a zip from upstream into the cache. Concurrent calls
+// for the same key share one upstream download. The zip is streamed into a
+// unique temp file in the cache directory and stored only once it is
+// complete (and, with verification enabled, matches the checksum database),
+// so readers never observe a partial or unverified zip.
+func (p *Proxy) downloadZip(ctx context.Context, mreq *moduleRequest) error {
+	key := mreq.Key()
+	_, err := p.coalesce(ctx, key, func() (interface{}, error) {
+		// A download that finished after the caller missed the cache, but
+		// before this one started, may have stored the zip already
+		if _, err := p.storage.Stat(ctx, key); err == nil {
+			return nil, nil
+		}
+
+		inFlight := downloadsInFlight.WithLabelValues(mreq.Kind.String())
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		// Use extended context timeout for zip files
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), zipFetchTimeout)
+		defer cancel()
+
+		resp, err := p.openUpstream(ctx, mreq.Module, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.ContentLength > 0 {
+			logger(ctx).Debug("Downloading zip", "key", key, "size", resp.ContentLength)
+		}
+
+		// Hidden temp files are not part of the storage, see diskStorage
+		tmp, err := os.CreateTemp(p.cacheDir, ".download.*.tmp")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		// Use CopyBuffer with larger buffer for better performance on large files
+		startTime := time.Now()
+		buf := make([]byte, 64*1024) // 64KB buffer
+		bytesCopied, err := io.CopyBuffer(tmp, resp.Body, buf)
+		if err == nil && resp.ContentLength > 0 && bytesCopied != resp.ContentLength {
+			err = fmt.Errorf("short body: got %d of %d bytes", bytesCopied, resp.ContentLength)
+		}
+		if err != nil {
+			logger(ctx).Error("Error copying zip", "key", key, "err", err, "bytes", bytesCopied, "duration_ms", millis(time.Since(startTime)))
+			return nil, err
+		}
+
+		if p.verifier != nil {
+			if err := p.verifier.verifyZip(mreq.Module, mreq.Version, tmp.Name()); err != nil {
+				return nil, err
+			}
+		}
+
+		// Store the complete zip (write lock)
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		unlock := p.locks.Lock(key)
+		err = p.storage.Put(ctx, key, tmp)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		logger(ctx).Info("Cached zip", "key", key, "bytes", bytesCopied, "duration_ms", millis(time.Since(startTime)))
+		if p.janitor != nil {
+			p.janitor.poke()
+		}
+		return nil, nil
+	})
+	return err
+}
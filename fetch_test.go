@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentZipDownload(t *testing.T) {
+	key := "example.com/m/@v/v1.0.0.zip"
+	zip := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(zip)
+
+	// Upstream answers only once every request is waiting for it
+	release := make(chan struct{})
+	upstream := newFakeUpstream(t, nil)
+	upstream.handler = func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Length", strconv.Itoa(len(zip)))
+		w.Write(zip)
+	}
+	storage := newMemStorage()
+	p := newTestProxy(t, upstream, storage)
+
+	const n = 30
+	var wg sync.WaitGroup
+	bodies := make([][]byte, n)
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := get(p, "/"+key)
+			codes[i], bodies[i] = w.Code, w.Body.Bytes()
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if codes[i] != http.StatusOK || !bytes.Equal(bodies[i], zip) {
+			t.Errorf("request %d: status %d, %d bytes differing from the zip", i, codes[i], len(bodies[i]))
+		}
+	}
+	if hits := upstream.hitCount(key); hits != 1 {
+		t.Errorf("%d upstream requests for %d concurrent downloads, want 1", hits, n)
+	}
+	if !bytes.Equal(storage.data(key), zip) {
+		t.Errorf("cached zip differs from upstream")
+	}
+}
+
+func TestShortZipDownload(t *testing.T) {
+	key := "example.com/m/@v/v1.0.0.zip"
+	upstream := newFakeUpstream(t, nil)
+	upstream.handler = func(w http.ResponseWriter, r *http.Request) {
+		// The connection is closed after fewer bytes than announced
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("truncated zip"))
+	}
+	storage := newMemStorage()
+	p := newTestProxy(t, upstream, storage)
+
+	if w := get(p, "/"+key); w.Code == http.StatusOK {
+		t.Errorf("truncated download served with status 200")
+	}
+	if data := storage.data(key); data != nil {
+		t.Errorf("truncated download was cached: %q", data)
+	}
+	entries, err := os.ReadDir(p.cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("left behind in the cache directory: %s", e.Name())
+	}
+}
+
+func TestFetchAfterConcurrentFetch(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]string{
+		"example.com/m/@v/v1.0.0.mod": "module example.com/m\n",
+		"example.com/m/@v/v1.0.0.zip": "zip",
+	})
+	storage := newMemStorage()
+	p := newTestProxy(t, upstream, storage)
+	ctx := context.Background()
+
+	// The caller missed the cache, then another caller's fetch cached the
+	// entries before this caller's started
+	for key, body := range map[string]string{
+		"example.com/m/@v/v1.0.0.mod": "cached mod",
+		"example.com/m/@v/v1.0.0.zip": "cached zip",
+	} {
+		storage.Put(ctx, key, strings.NewReader(body))
+	}
+	mreq, err := parseRequest("example.com/m/@v/v1.0.0.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := p.fetchAndCache(ctx, mreq, true, nil); err != nil || string(data) != "cached mod" {
+		t.Errorf("fetchAndCache = %q, %v, want the cached mod", data, err)
+	}
+	if mreq, err = parseRequest("example.com/m/@v/v1.0.0.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.downloadZip(ctx, mreq); err != nil {
+		t.Errorf("downloadZip: %v", err)
+	}
+	for _, key := range []string{"example.com/m/@v/v1.0.0.mod", "example.com/m/@v/v1.0.0.zip"} {
+		if hits := upstream.hitCount(key); hits != 0 {
+			t.Errorf("%d upstream requests for the cached %s", hits, key)
+		}
+	}
+}
+
+// listUpstream is a fake upstream serving the list of example.com/m with
+// validators, answering conditional requests with 304 and every request
+// with status instead if that is set
+type listUpstream struct {
+	*fakeUpstream
+	status int
+	header http.Header // of the last request
+}
+
+const (
+	testList     = "v1.0.0\n"
+	testListETag = `"v1"`
+	testListDate = "Mon, 01 Jan 2024 00:00:00 GMT"
+)
+
+func newListUpstream(t *testing.T) *listUpstream {
+	u := &listUpstream{fakeUpstream: newFakeUpstream(t, nil)}
+	u.handler = func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.header = r.Header.Clone()
+		status := u.status
+		u.mu.Unlock()
+		switch {
+		case status != 0:
+			w.WriteHeader(status)
+		case r.Header.Get("If-None-Match") == testListETag:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", testListETag)
+			w.Header().Set("Last-Modified", testListDate)
+			io.WriteString(w, testList)
+		}
+	}
+	return u
+}
+
+// set makes upstream answer with status, or normally if status is 0
+func (u *listUpstream) set(status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = status
+}
+
+// age makes the cached entry for key look fetched age ago
+func age(t *testing.T, p *Proxy, key string, age time.Duration) {
+	t.Helper()
+	ctx := context.Background()
+	meta := p.readCacheMeta(ctx, key)
+	meta.Fetched = time.Now().Add(-age)
+	if err := p.writeCacheMeta(ctx, key, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchMutable(t *testing.T) {
+	const key = "example.com/m/@v/list"
+	upstream := newListUpstream(t)
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: newMemStorage(), ListTTL: time.Hour})
+	check := func(when string, code int, hits int) {
+		t.Helper()
+		w := get(p, "/"+key)
+		if w.Code != code || (code == http.StatusOK && w.Body.String() != testList) {
+			t.Errorf("%s: GET = %d %q, want %d", when, w.Code, w.Body, code)
+		}
+		if n := upstream.hitCount(key); n != hits {
+			t.Errorf("%s: %d upstream requests in total, want %d", when, n, hits)
+		}
+	}
+
+	// Within the TTL, the cached copy is served as is
+	check("first request", http.StatusOK, 1)
+	check("within the TTL", http.StatusOK, 1)
+
+	// After it, it is revalidated, and a 304 restarts the TTL
+	age(t, p, key, 2*time.Hour)
+	check("after the TTL", http.StatusOK, 2)
+	upstream.mu.Lock()
+	if h := upstream.header; h.Get("If-None-Match") != testListETag || h.Get("If-Modified-Since") != testListDate {
+		t.Errorf("revalidated with If-None-Match %q and If-Modified-Since %q", h.Get("If-None-Match"), h.Get("If-Modified-Since"))
+	}
+	upstream.mu.Unlock()
+	check("after a 304", http.StatusOK, 2)
+
+	// Upstream failures serve the stale copy, unless the module is gone
+	age(t, p, key, 2*time.Hour)
+	upstream.set(http.StatusInternalServerError)
+	check("after a 500", http.StatusOK, 3)
+	upstream.set(http.StatusNotFound)
+	check("after a 404", http.StatusNotFound, 4)
+}
+
+func TestListTTL(t *testing.T) {
+	const key = "example.com/m/@v/list"
+	upstream := newListUpstream(t)
+
+	// With a TTL of 0 every request revalidates
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: newMemStorage()})
+	for i := 1; i <= 3; i++ {
+		if w := get(p, "/"+key); w.Code != http.StatusOK || w.Body.String() != testList {
+			t.Errorf("GET = %d %q", w.Code, w.Body)
+		}
+		if n := upstream.hitCount(key); n != i {
+			t.Errorf("%d upstream requests for %d with a TTL of 0", n, i)
+		}
+	}
+
+	if _, err := NewProxy(Config{CacheDir: t.TempDir(), Upstream: upstream.URL, ListTTL: -time.Minute}); err == nil {
+		t.Errorf("negative list TTL accepted")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// janitorInterval is how often the janitor checks the cache size
+const janitorInterval = time.Minute
+
+// Eviction policies for -cache-policy
+const (
+	policyLRU = "lru" // least recently used first
+	policyLFU = "lfu" // least frequently used first, then least recently used
+)
+
+// janitorLowWater is the fraction of the quota the janitor evicts down to,
+// so that it does not run again after every single download
+const janitorLowWater = 0.9
+
+// accessEntry records how a cache key has been used since startup
+type accessEntry struct {
+	last time.Time
+	hits int64
+}
+
+// janitor keeps the cache storage under a size quota by evicting the least
+// recently or least frequently used artifacts, zips first. Access times are
+// tracked by the proxy itself because atime is often disabled (noatime) or
+// coarse; keys not used since startup count as last used at their mtime.
+// Entries that are locked (being streamed to a client or written) are skipped.
+type janitor struct {
+	proxy   *Proxy
+	maxSize int64
+	policy  string
+	wake    chan struct{}
+
+	mu     sync.Mutex
+	access map[string]*accessEntry
+
+	evictedFiles atomic.Int64 // files evicted since startup
+	evictedBytes atomic.Int64 // bytes reclaimed since startup
+}
+
+// newJanitor creates a janitor for p that keeps the cache under maxSize bytes
+func newJanitor(p *Proxy, maxSize int64, policy string) (*janitor, error) {
+	switch policy {
+	case "":
+		policy = policyLRU
+	case policyLRU, policyLFU:
+	default:
+		return nil, fmt.Errorf("invalid cache policy %q (supported: %s, %s)", policy, policyLRU, policyLFU)
+	}
+	return &janitor{
+		proxy:   p,
+		maxSize: maxSize,
+		policy:  policy,
+		wake:    make(chan struct{}, 1),
+		access:  make(map[string]*accessEntry),
+	}, nil
+}
+
+// touch records an access to the cache entry key
+func (j *janitor) touch(key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.access[key]
+	if !ok {
+		e = &accessEntry{}
+		j.access[key] = e
+	}
+	e.last = time.Now()
+	e.hits++
+}
+
+// poke asks the janitor to check the cache size soon, e.g. after a download
+func (j *janitor) poke() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run checks the cache size every janitorInterval and whenever poked
+func (j *janitor) run() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		j.sweep()
+		select {
+		case <-ticker.C:
+		case <-j.wake:
+		}
+	}
+}
+
+// cacheFile is an evictable cache entry found by sweep
+type cacheFile struct {
+	key  string
+	size int64 // including its .meta sidecar
+	zip  bool
+	last time.Time
+	hits int64
+}
+
+// sweep evicts cache entries until the cache is below the low water mark,
+// if it is over the quota
+func (j *janitor) sweep() {
+	ctx := context.Background()
+	entries, err := j.proxy.storage.List(ctx, "")
+	if err != nil {
+		slog.Warn("Janitor failed to list the cache", "err", err)
+		return
+	}
+
+	var total int64
+	var files []cacheFile
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		total += e.Size
+		sizes[e.Key] = e.Size
+		// Sidecars and verifier state count towards the size but are never
+		// evicted on their own
+		if strings.HasSuffix(e.Key, ".meta") || strings.HasPrefix(e.Key, "sumdb-verifier/") {
+			continue
+		}
+		files = append(files, cacheFile{
+			key:  e.Key,
+			size: e.Size,
+			zip:  strings.HasSuffix(e.Key, ".zip"),
+			last: e.ModTime,
+		})
+	}
+
+	j.mu.Lock()
+	for i := range files {
+		files[i].size += sizes[files[i].key+".meta"]
+		if e, ok := j.access[files[i].key]; ok {
+			files[i].last, files[i].hits = e.last, e.hits
+		}
+	}
+	// Forget keys that are no longer cached (misses, evicted entries)
+	for key := range j.access {
+		if _, ok := sizes[key]; !ok {
+			delete(j.access, key)
+		}
+	}
+	j.mu.Unlock()
+
+	j.proxy.size.set(total)
+	if total <= j.maxSize {
+		return
+	}
+	target := int64(float64(j.maxSize) * janitorLowWater)
+	slog.Info("Cache size exceeds quota; evicting", "size", total, "quota", j.maxSize, "policy", j.policy, "target", target)
+
+	sort.Slice(files, func(a, b int) bool {
+		fa, fb := files[a], files[b]
+		if fa.zip != fb.zip {
+			return fa.zip
+		}
+		if j.policy == policyLFU && fa.hits != fb.hits {
+			return fa.hits < fb.hits
+		}
+		return fa.last.Before(fb.last)
+	})
+
+	var evicted, reclaimed int64
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		// Skip entries that are being streamed to a client or written
+		unlock, ok := j.proxy.locks.TryLock(f.key)
+		if !ok {
+			continue
+		}
+		err := j.proxy.storage.Delete(ctx, f.key)
+		j.proxy.storage.Delete(ctx, f.key+".meta")
+		unlock()
+		if err != nil {
+			slog.Warn("Failed to evict", "key", f.key, "err", err)
+			continue
+		}
+
+		j.mu.Lock()
+		delete(j.access, f.key)
+		j.mu.Unlock()
+		total -= f.size
+		evicted++
+		reclaimed += f.size
+	}
+
+	j.proxy.size.set(total)
+	j.evictedFiles.Add(evicted)
+	j.evictedBytes.Add(reclaimed)
+	slog.Info("Janitor evicted cache entries", "files", evicted, "bytes", reclaimed, "size", total)
+}
+
+// parseSize parses a byte size such as "512M", "10G" or "1073741824".
+// Suffixes (K, M, G, T, optionally followed by "B" or "iB") are powers of 1024.
+func parseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestJanitor returns a janitor keeping the storage of a test proxy under
+// maxSize bytes. It is not started, so tests run its sweeps themselves.
+func newTestJanitor(t *testing.T, maxSize int64, policy string) (*janitor, *memStorage) {
+	t.Helper()
+	storage := newMemStorage()
+	p := newTestProxy(t, newFakeUpstream(t, nil), storage)
+	j, err := newJanitor(p, maxSize, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.janitor = j
+	return j, storage
+}
+
+// putSized stores an entry of size bytes for every key
+func putSized(t *testing.T, s Storage, size int, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if err := s.Put(context.Background(), key, strings.NewReader(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// touchInOrder records accesses to keys, each later than the previous one
+func touchInOrder(j *janitor, keys ...string) {
+	for _, key := range keys {
+		time.Sleep(time.Millisecond)
+		j.touch(key)
+	}
+}
+
+// storedKeys returns the sorted keys in s
+func storedKeys(t *testing.T, s Storage) string {
+	t.Helper()
+	entries, err := s.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+func TestJanitorZipsFirst(t *testing.T) {
+	j, storage := newTestJanitor(t, 200, policyLRU)
+	putSized(t, storage, 10, "m/@v/list", "m/@v/list.meta")
+	time.Sleep(time.Millisecond)
+	putSized(t, storage, 10, "m/@v/v1.0.0.info", "m/@v/v1.0.0.mod")
+	putSized(t, storage, 50, "m/@v/v1.0.0.zip", "m/@v/v1.1.0.zip", "m/@v/v1.2.0.zip")
+	time.Sleep(time.Millisecond)
+	// The small entries are older, but zips go first
+	touchInOrder(j, "m/@v/v1.2.0.zip", "m/@v/v1.0.0.zip")
+
+	// Under the quota nothing is evicted
+	j.sweep()
+	if keys := storedKeys(t, storage); strings.Count(keys, " ") != 6 {
+		t.Fatalf("sweep under the quota left %s", keys)
+	}
+
+	// 240 bytes are evicted down to 90% of a 200 byte quota, least recently
+	// used zip first
+	putSized(t, storage, 50, "m/@v/v1.3.0.zip")
+	touchInOrder(j, "m/@v/v1.3.0.zip")
+	j.sweep()
+	want := "m/@v/list m/@v/list.meta m/@v/v1.0.0.info m/@v/v1.0.0.mod m/@v/v1.0.0.zip m/@v/v1.3.0.zip"
+	if keys := storedKeys(t, storage); keys != want {
+		t.Errorf("after eviction: %s, want %s", keys, want)
+	}
+	if files, bytes := j.evictedFiles.Load(), j.evictedBytes.Load(); files != 2 || bytes != 100 {
+		t.Errorf("evicted %d files of %d bytes, want 2 of 100", files, bytes)
+	}
+
+	// Once the zips are gone, the least recently used other entry goes.
+	// Its sidecar goes with it and counts towards its size, so evicting it
+	// reaches the 63 byte low water mark.
+	j.maxSize = 70
+	putSized(t, storage, 40, "m/@v/v1.4.0.info")
+	j.sweep()
+	want = "m/@v/v1.0.0.info m/@v/v1.0.0.mod m/@v/v1.4.0.info"
+	if keys := storedKeys(t, storage); keys != want {
+		t.Errorf("after eviction: %s, want %s", keys, want)
+	}
+}
+
+func TestJanitorPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		evicted string
+	}{
+		{policyLRU, "a.info"},
+		{policyLFU, "c.info"},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			j, storage := newTestJanitor(t, 25, tt.policy)
+			putSized(t, storage, 10, "a.info", "b.info", "c.info")
+			// a is the most frequently but least recently used entry, c
+			// the least frequently and least recently used of the others
+			touchInOrder(j, "a.info", "a.info", "a.info", "c.info", "b.info")
+			j.sweep()
+			keys := storedKeys(t, storage)
+			if strings.Contains(keys, tt.evicted) || strings.Count(keys, " ") != 1 {
+				t.Errorf("after eviction: %s, want all but %s", keys, tt.evicted)
+			}
+		})
+	}
+
+	if _, err := newJanitor(nil, 1, "fifo"); err == nil {
+		t.Errorf("unsupported policy accepted")
+	}
+}
+
+func TestJanitorSkipsLocked(t *testing.T) {
+	j, storage := newTestJanitor(t, 25, policyLRU)
+	putSized(t, storage, 10, "a.zip", "b.zip", "c.zip")
+	touchInOrder(j, "a.zip", "b.zip", "c.zip")
+
+	// The least recently used zip is being streamed to a client
+	unlock := j.proxy.locks.RLock("a.zip")
+	j.sweep()
+	unlock()
+	if keys := storedKeys(t, storage); keys != "a.zip c.zip" {
+		t.Errorf("after eviction: %s, want a.zip c.zip", keys)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// keyedMutex provides one read/write lock per cache key, so that work on one
+// artifact never blocks readers of unrelated artifacts.
+//
+// Readers hold the read lock for as long as they read a cache entry (for a
+// zip, the whole time it is streamed to the client). Writers hold the write
+// lock only while they commit or remove an entry. Entries are reference
+// counted and dropped once nobody holds or waits on them, so the map only
+// holds keys that are in use. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is a lock for a single key together with its reference count
+type keyedLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// acquire returns the lock for key, creating it if needed, and takes a reference
+func (k *keyedMutex) acquire(key string) *keyedLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// release drops a reference to the lock for key
+func (k *keyedMutex) release(key string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// Lock locks key for writing and returns the function that unlocks it
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	l := k.acquire(key)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.release(key, l)
+	}
+}
+
+// RLock locks key for reading and returns the function that unlocks it
+func (k *keyedMutex) RLock(key string) (unlock func()) {
+	l := k.acquire(key)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		k.release(key, l)
+	}
+}
+
+// TryLock locks key for writing if nobody holds it, without waiting. It
+// reports whether it succeeded; if so the caller must call unlock.
+func (k *keyedMutex) TryLock(key string) (unlock func(), ok bool) {
+	l := k.acquire(key)
+	if !l.TryLock() {
+		k.release(key, l)
+		return nil, false
+	}
+	return func() {
+		l.Unlock()
+		k.release(key, l)
+	}, true
+}
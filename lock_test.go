@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockCount returns the number of keys k holds locks for
+func (k *keyedMutex) lockCount() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.locks)
+}
+
+func TestKeyedMutexCleanup(t *testing.T) {
+	var k keyedMutex
+	r1 := k.RLock("a")
+	r2 := k.RLock("a")
+	w := k.Lock("b")
+	if n := k.lockCount(); n != 2 {
+		t.Errorf("%d keys locked, want 2", n)
+	}
+	r1()
+	if n := k.lockCount(); n != 2 {
+		t.Errorf("key dropped while a reader still holds it: %d keys locked", n)
+	}
+	r2()
+	w()
+	if n := k.lockCount(); n != 0 {
+		t.Errorf("%d keys left after every lock was released", n)
+	}
+
+	// A writer waiting for a reader keeps the key alive
+	r := k.RLock("a")
+	locked := make(chan func())
+	go func() { locked <- k.Lock("a") }()
+	time.Sleep(10 * time.Millisecond)
+	r()
+	(<-locked)()
+	if n := k.lockCount(); n != 0 {
+		t.Errorf("%d keys left after every lock was released", n)
+	}
+}
+
+func TestKeyedMutexTryLock(t *testing.T) {
+	var k keyedMutex
+	r := k.RLock("a")
+	if _, ok := k.TryLock("a"); ok {
+		t.Fatalf("TryLock succeeded while a reader holds the key")
+	}
+	unlock, ok := k.TryLock("b")
+	if !ok {
+		t.Fatalf("TryLock of an unrelated key failed")
+	}
+	if _, ok := k.TryLock("b"); ok {
+		t.Fatalf("TryLock succeeded while a writer holds the key")
+	}
+	unlock()
+	r()
+	if n := k.lockCount(); n != 0 {
+		t.Errorf("%d keys left after every lock was released", n)
+	}
+	unlock, ok = k.TryLock("a")
+	if !ok {
+		t.Fatalf("TryLock of a released key failed")
+	}
+	unlock()
+}
+
+// TestConcurrentHitMissPurge serves cache hits and misses while the entries
+// are purged, so that go test -race checks the locking of the handlers
+func TestConcurrentHitMissPurge(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		v := fmt.Sprintf("v1.0.%d", i)
+		files["example.com/m/@v/"+v+".info"] = fmt.Sprintf(`{"Version":%q}`, v)
+		files["example.com/m/@v/"+v+".mod"] = "module example.com/m\n// " + v + "\n"
+		files["example.com/m/@v/"+v+".zip"] = "zip of " + v
+	}
+	upstream := newFakeUpstream(t, files)
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// ctx only bounds the test: an operation it ended would fail
+		for ctx.Err() == nil {
+			entries, err := p.storage.List(context.Background(), "example.com/m/")
+			if err != nil {
+				t.Errorf("List: %v", err)
+				return
+			}
+			if _, _, err := p.purge(context.Background(), entries); err != nil {
+				t.Errorf("purge: %v", err)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				for key, body := range files {
+					w := get(p, "/"+key)
+					if w.Code != http.StatusOK || w.Body.String() != body {
+						t.Errorf("GET %s = %d %q, want 200 %q", key, w.Code, w.Body, body)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// requestIDHeader carries the request ID. An ID sent by the client (e.g. a
+// load balancer) is kept; otherwise a new one is generated.
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID matches request IDs accepted from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Cache statuses recorded in access log records
+const (
+	cacheHit         = "hit"         // served from the cache
+	cacheMiss        = "miss"        // fetched from upstream
+	cacheRefresh     = "refresh"     // expired list or @latest replaced by upstream
+	cacheRevalidated = "revalidated" // expired list or @latest confirmed by upstream (304)
+	cacheStale       = "stale"       // expired copy served because upstream failed
+	cacheOffline     = "offline"     // computed from cached .info files
+)
+
+// newLogger creates the process logger writing to w in format ("text" or
+// "json") at level ("debug", "info", "warn" or "error")
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (supported: debug, info, warn, error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q (supported: text, json)", format)
+	}
+}
+
+// accessRecord collects what happened while handling a request, for its
+// access log record. It travels in the request context, so code deep in the
+// fetch path can fill it in. It is not locked: code fetching concurrently
+// for one request must give every goroutine a record of its own, as
+// Proxy.warm does.
+type accessRecord struct {
+	id        string
+	cache     string // one of the cache* statuses
+	upstream  string // upstream that served the fetch
+	coalesced bool   // waited for another request's fetch
+}
+
+type accessKey struct{}
+
+// withAccess returns a context carrying rec
+func withAccess(ctx context.Context, rec *accessRecord) context.Context {
+	return context.WithValue(ctx, accessKey{}, rec)
+}
+
+// accessFrom returns the access record of ctx. Outside a request it returns
+// a throwaway record, so callers never need to check.
+func accessFrom(ctx context.Context) *accessRecord {
+	if rec, ok := ctx.Value(accessKey{}).(*accessRecord); ok {
+		return rec
+	}
+	return &accessRecord{}
+}
+
+// logger returns the default logger, tagged with the request ID of ctx if
+// it belongs to a request
+func logger(ctx context.Context) *slog.Logger {
+	if rec, ok := ctx.Value(accessKey{}).(*accessRecord); ok {
+		return slog.Default().With("request_id", rec.id)
+	}
+	return slog.Default()
+}
+
+// requestID returns the client's request ID if it is valid, or a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// logAccess writes the access log record of a request. kind and mreq
+// describe the request as far as it could be parsed.
+func logAccess(r *http.Request, rec *accessRecord, w *statusWriter, kind string, mreq *moduleRequest, elapsed time.Duration) {
+	attrs := []slog.Attr{
+		slog.String("request_id", rec.id),
+		slog.String("client", r.RemoteAddr),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("kind", kind),
+	}
+	if mreq != nil {
+		attrs = append(attrs, slog.String("module", mreq.Module))
+		if mreq.Version != "" {
+			attrs = append(attrs, slog.String("version", mreq.Version))
+		}
+	}
+	if rec.cache != "" {
+		attrs = append(attrs, slog.String("cache", rec.cache))
+	}
+	if rec.upstream != "" {
+		attrs = append(attrs, slog.String("upstream", rec.upstream))
+	}
+	if rec.coalesced {
+		attrs = append(attrs, slog.Bool("coalesced", true))
+	}
+	attrs = append(attrs,
+		slog.Int("status", w.statusCode()),
+		slog.Int64("bytes", w.bytes),
+		slog.Float64("duration_ms", millis(elapsed)),
+	)
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+}
+
+// millis converts d to fractional milliseconds for log records
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// logFetchError logs a failed fetch of key. Not found answers are routine
+// (the go command probes module path prefixes) and are logged at info level.
+func logFetchError(ctx context.Context, key string, err error) {
+	level := slog.LevelError
+	if isNotFound(err) {
+		level = slog.LevelInfo
+	}
+	logger(ctx).Log(ctx, level, "Failed to fetch", "key", key, "err", err)
+}
+
+// markCoalesced records that the request waited for another request's
+// fetch of key instead of starting its own
+func markCoalesced(ctx context.Context, key string) {
+	accessFrom(ctx).coalesced = true
+	logger(ctx).Debug("Coalesced with an in-flight fetch", "key", key)
+}
+
+// cacheResult records the outcome of a cache lookup for key in the access
+// record and metrics. Answers computed from the cache in offline mode count
+// as hits, anything else as a miss.
+func cacheResult(ctx context.Context, kind, key, status string) {
+	if status == cacheHit || status == cacheOffline {
+		cacheHits.WithLabelValues(kind).Inc()
+	} else {
+		cacheMisses.WithLabelValues(kind).Inc()
+	}
+	accessFrom(ctx).cache = status
+	logger(ctx).Debug("Cache lookup", "key", key, "cache", status)
+}
@@ -5,23 +5,92 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 var (
-	port      = flag.String("port", "12345", "Port to listen on")
-	cacheDir  = flag.String("cache", "./cache", "Cache directory path")
-	upstream  = flag.String("upstream", "https://proxy.golang.org", "Upstream proxy URL")
-	httpProxy = flag.String("proxy", "", "HTTP/HTTPS/SOCKS5 proxy URL (e.g., http://proxy:8080 or socks5://proxy:1080)")
-	dnsServer = flag.String("dns", "", "DNS server URL (e.g., 8.8.8.8:53, https://cloudflare-dns.com/dns-query, tls://1.1.1.1:853)")
+	port       = flag.String("port", "12345", "Port to listen on")
+	cacheDir   = flag.String("cache", "./cache", "Cache directory path")
+	upstream   = flag.String("upstream", "https://proxy.golang.org", "Upstream proxy URL, or a GOPROXY-style list (',' falls through on 404/410, '|' on any error)")
+	httpProxy  = flag.String("proxy", "", "HTTP/HTTPS/SOCKS5 proxy URL (e.g., http://proxy:8080 or socks5://proxy:1080)")
+	dnsServer  = flag.String("dns", "", "DNS server URL (e.g., 8.8.8.8:53, https://cloudflare-dns.com/dns-query, tls://1.1.1.1:853)")
+	dnsMinTTL  = flag.Duration("dns-cache-min-ttl", defaultDNSCacheMinTTL, "Minimum time DNS answers from -dns servers are cached, even if their TTL is lower")
+	dnsMaxTTL  = flag.Duration("dns-cache-max-ttl", defaultDNSCacheMaxTTL, "Maximum time DNS answers from -dns servers are cached (0 disables the DNS cache)")
+	sumDBs     = flag.String("sumdb", defaultSumDB, "Comma-separated checksum databases to proxy under /sumdb/ (empty to disable)")
+	verify     = flag.Bool("verify", false, "Verify downloaded zips and go.mod files against the checksum database before caching them")
+	verifyKey  = flag.String("verify-key", defaultSumDBKey, "Checksum database used by -verify, in GOSUMDB name+hash+key form")
+	noSumDB    = flag.String("nosumdb", "", "Comma-separated module path globs that -verify skips (like GONOSUMDB)")
+	listTTL    = flag.Duration("list-ttl", defaultListTTL, "How long @v/list and @latest responses are served before revalidating with upstream; 0 revalidates on every request")
+	offline    = flag.Bool("offline", false, "Serve from cache only and never contact upstream (air-gapped networks)")
+	cacheMax   = flag.String("cache-max-size", "", "Cache size quota, e.g. 10G; least used entries (zips first) are evicted above it (empty for no limit)")
+	cachePol   = flag.String("cache-policy", policyLRU, "Eviction policy for -cache-max-size: lru or lfu")
+	cacheMem   = flag.String("cache-memory-size", "0", "Size of the in-memory LRU tier for small artifacts (.info, .mod, lists), e.g. 32M; 0 disables it")
+	s3Bucket   = flag.String("s3-bucket", "", "Store the cache in this S3-compatible bucket instead of the cache directory")
+	s3Endpoint = flag.String("s3-endpoint", "s3.amazonaws.com", "S3 endpoint host[:port], e.g. minio:9000")
+	s3Prefix   = flag.String("s3-prefix", "", "Object key prefix for the cache inside the bucket")
+	s3Region   = flag.String("s3-region", "", "S3 region (empty to detect)")
+	s3Insecure = flag.Bool("s3-insecure", false, "Use plain HTTP for the S3 endpoint")
+	logFormat  = flag.String("log-format", "text", "Log format: text or json")
+	logLevel   = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	adminAddr  = flag.String("admin-addr", "", "Listen address of the admin API, e.g. 127.0.0.1:12346 (empty to disable)")
+	adminToken = flag.String("admin-token", "", "Bearer token required by the admin API (prefer the ADMIN_TOKEN environment variable)")
+	warmJobs   = flag.Int("warm-concurrency", defaultWarmConcurrency, "Module versions downloaded at once by warm-ups")
+	routes     routeFlag
 )
 
+func init() {
+	flag.Var(&routes, "route", "Route matching modules to other upstreams: patterns=upstreams[;proxy=URL][;dns=SERVER] (repeatable)")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, "Usage:")
+		fmt.Fprintln(out, "  goproxy [flags]                  serve the module proxy")
+		fmt.Fprintln(out, "  goproxy warm [flags] inputs...   download go.mod/go.sum/list files or module@version into the cache")
+		fmt.Fprintln(out, "\nFlags:")
+		flag.PrintDefaults()
+	}
+}
+
+// routeFlag collects repeated -route flags
+type routeFlag []string
+
+func (f *routeFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *routeFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
-	flag.Parse()
+	// "goproxy warm" fills the cache instead of serving it
+	args := os.Args[1:]
+	warmMode := len(args) > 0 && args[0] == "warm"
+	if warmMode {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	// Set up logging first, so that everything below is logged in the
+	// configured format
+	if envFormat := os.Getenv("LOG_FORMAT"); envFormat != "" {
+		*logFormat = envFormat
+	}
+	if envLevel := os.Getenv("LOG_LEVEL"); envLevel != "" {
+		*logLevel = envLevel
+	}
+	l, err := newLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(l)
 
 	// Support environment variables (env vars override flags)
 	if envPort := os.Getenv("PORT"); envPort != "" {
@@ -33,6 +102,87 @@ func main() {
 	if envUpstream := os.Getenv("UPSTREAM_PROXY"); envUpstream != "" {
 		*upstream = envUpstream
 	}
+	if envMax := os.Getenv("CACHE_MAX_SIZE"); envMax != "" {
+		*cacheMax = envMax
+	}
+	if envPolicy := os.Getenv("CACHE_POLICY"); envPolicy != "" {
+		*cachePol = envPolicy
+	}
+	if envMem := os.Getenv("CACHE_MEMORY_SIZE"); envMem != "" {
+		*cacheMem = envMem
+	}
+	if envBucket := os.Getenv("S3_BUCKET"); envBucket != "" {
+		*s3Bucket = envBucket
+	}
+	if envEndpoint := os.Getenv("S3_ENDPOINT"); envEndpoint != "" {
+		*s3Endpoint = envEndpoint
+	}
+	if envPrefix := os.Getenv("S3_PREFIX"); envPrefix != "" {
+		*s3Prefix = envPrefix
+	}
+	if envRegion := os.Getenv("S3_REGION"); envRegion != "" {
+		*s3Region = envRegion
+	}
+	if envInsecure := os.Getenv("S3_INSECURE"); envInsecure != "" {
+		*s3Insecure = envInsecure == "1" || strings.EqualFold(envInsecure, "true")
+	}
+	if envAdmin := os.Getenv("ADMIN_ADDR"); envAdmin != "" {
+		*adminAddr = envAdmin
+	}
+	if envToken := os.Getenv("ADMIN_TOKEN"); envToken != "" {
+		*adminToken = envToken
+	}
+	if envWarm := os.Getenv("WARM_CONCURRENCY"); envWarm != "" {
+		n, err := strconv.Atoi(envWarm)
+		if err != nil {
+			fatal("Invalid WARM_CONCURRENCY", "value", envWarm, "err", err)
+		}
+		*warmJobs = n
+	}
+	if envRoutes := os.Getenv("UPSTREAM_ROUTES"); envRoutes != "" {
+		routes = strings.Fields(envRoutes)
+	}
+	if envTTL := os.Getenv("LIST_TTL"); envTTL != "" {
+		ttl, err := time.ParseDuration(envTTL)
+		if err != nil {
+			fatal("Invalid LIST_TTL", "value", envTTL, "err", err)
+		}
+		*listTTL = ttl
+	}
+	if envTTL := os.Getenv("DNS_CACHE_MIN_TTL"); envTTL != "" {
+		ttl, err := time.ParseDuration(envTTL)
+		if err != nil {
+			fatal("Invalid DNS_CACHE_MIN_TTL", "value", envTTL, "err", err)
+		}
+		*dnsMinTTL = ttl
+	}
+	if envTTL := os.Getenv("DNS_CACHE_MAX_TTL"); envTTL != "" {
+		ttl, err := time.ParseDuration(envTTL)
+		if err != nil {
+			fatal("Invalid DNS_CACHE_MAX_TTL", "value", envTTL, "err", err)
+		}
+		*dnsMaxTTL = ttl
+	}
+	if envSumDB, ok := os.LookupEnv("SUMDB"); ok {
+		*sumDBs = envSumDB
+	}
+	if envVerify := os.Getenv("VERIFY"); envVerify != "" {
+		*verify = envVerify == "1" || strings.EqualFold(envVerify, "true")
+	}
+	if envOffline := os.Getenv("OFFLINE"); envOffline != "" {
+		*offline = envOffline == "1" || strings.EqualFold(envOffline, "true")
+	}
+	if envKey := os.Getenv("VERIFY_KEY"); envKey != "" {
+		*verifyKey = envKey
+	}
+	// Modules skipped by verification (only if flag not set), like the go command
+	if *noSumDB == "" {
+		if env := os.Getenv("GONOSUMDB"); env != "" {
+			*noSumDB = env
+		} else if env := os.Getenv("GOPRIVATE"); env != "" {
+			*noSumDB = env
+		}
+	}
 	// Proxy from environment (only if flag not set)
 	if *httpProxy == "" {
 		if envProxy := os.Getenv("HTTP_PROXY"); envProxy != "" {
@@ -50,13 +200,77 @@ func main() {
 		}
 	}
 
+	var maxSize int64
+	if *cacheMax != "" {
+		size, err := parseSize(*cacheMax)
+		if err != nil {
+			fatal("Invalid cache size", "err", err)
+		}
+		maxSize = size
+	}
+	memSize, err := parseSize(*cacheMem)
+	if err != nil {
+		fatal("Invalid memory cache size", "err", err)
+	}
+
+	var routeList []Route
+	for _, spec := range routes {
+		r, err := parseRoute(spec)
+		if err != nil {
+			fatal("Invalid route", "err", err)
+		}
+		routeList = append(routeList, r)
+	}
+
 	// Ensure cache directory exists
 	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
-		log.Fatalf("Failed to create cache directory: %v", err)
+		fatal("Failed to create cache directory", "err", err)
+	}
+
+	var storage Storage
+	if *s3Bucket != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		s3, err := newS3Storage(ctx, S3Config{
+			Endpoint: *s3Endpoint,
+			Bucket:   *s3Bucket,
+			Prefix:   *s3Prefix,
+			Region:   *s3Region,
+			Insecure: *s3Insecure,
+		})
+		cancel()
+		if err != nil {
+			fatal("Failed to open S3 storage", "err", err)
+		}
+		storage = s3
 	}
 
 	// Create proxy handler
-	proxy := NewProxy(*cacheDir, *upstream, *httpProxy, *dnsServer)
+	proxy, err := NewProxy(Config{
+		CacheDir:  *cacheDir,
+		Storage:   storage,
+		Upstream:  *upstream,
+		HTTPProxy: *httpProxy,
+		DNSServer: *dnsServer,
+		Routes:    routeList,
+		ListTTL:   *listTTL,
+		Offline:   *offline,
+
+		DNSCacheMinTTL:  *dnsMinTTL,
+		DNSCacheMaxTTL:  *dnsMaxTTL,
+		CacheMemorySize: memSize,
+		CacheMaxSize:    maxSize,
+		CachePolicy:     *cachePol,
+		SumDBs:          splitList(*sumDBs),
+		Verify:          *verify,
+		VerifyKey:       *verifyKey,
+		NoSumDB:         *noSumDB,
+	})
+	if err != nil {
+		fatal("Failed to create proxy", "err", err)
+	}
+	if warmMode {
+		os.Exit(runWarm(proxy, flag.Args(), *warmJobs))
+	}
 
 	// Setup HTTP server
 	mux := http.NewServeMux()
@@ -71,41 +285,109 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// The admin API gets its own listener, so it can be bound to a private
+	// interface or firewalled separately
+	var adminSrv *http.Server
+	if *adminAddr != "" {
+		admin, err := newAdminHandler(proxy, *adminToken, *warmJobs)
+		if err != nil {
+			fatal("Failed to create admin API", "err", err)
+		}
+		adminSrv = &http.Server{
+			Addr:         *adminAddr,
+			Handler:      admin,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 10 * time.Minute, // refreshing many modules takes a while
+			IdleTimeout:  60 * time.Second,
+		}
+	}
+
 	// Log startup configuration
-	log.Printf("Starting Go module proxy server")
-	log.Printf("  Port: %s", *port)
-	log.Printf("  Cache directory: %s", *cacheDir)
-	log.Printf("  Upstream proxy: %s", *upstream)
+	config := []any{"port", *port, "cache_dir", *cacheDir}
+	if *s3Bucket != "" {
+		config = append(config, "s3_bucket", *s3Bucket, "s3_endpoint", *s3Endpoint, "s3_prefix", *s3Prefix)
+	}
+	if memSize > 0 {
+		config = append(config, "memory_tier", memSize)
+	}
+	if maxSize > 0 {
+		config = append(config, "cache_quota", maxSize, "cache_policy", *cachePol)
+	}
+	if *offline {
+		config = append(config, "offline", true)
+	} else {
+		config = append(config, "upstream", *upstream)
+	}
+	config = append(config, "list_ttl", listTTL.String())
+	if *sumDBs != "" {
+		config = append(config, "sumdb", *sumDBs)
+	}
 	if *httpProxy != "" {
-		log.Printf("  HTTP/SOCKS5 proxy: %s", *httpProxy)
+		config = append(config, "proxy", *httpProxy)
 	}
 	if *dnsServer != "" {
-		log.Printf("  DNS server: %s", *dnsServer)
+		config = append(config, "dns", *dnsServer, "dns_cache_max_ttl", dnsMaxTTL.String())
+	}
+	if adminSrv != nil {
+		config = append(config, "admin", *adminAddr)
 	}
-	log.Printf("  Set GOPROXY=http://localhost%s,direct", addr)
+	slog.Info("Starting Go module proxy server", config...)
+	for _, r := range routeList {
+		slog.Info("Route", "patterns", r.Patterns, "upstream", r.Upstream)
+	}
+	slog.Info(fmt.Sprintf("Set GOPROXY=http://localhost%s,direct", addr))
 
 	// Start server in a goroutine
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed: %v", err)
+			fatal("Server failed", "err", err)
 		}
 	}()
 
+	if adminSrv != nil {
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Admin server failed", "err", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal for graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server...")
 
 	// Create context with timeout for graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	// Shutdown server gracefully
+	if adminSrv != nil {
+		adminSrv.Shutdown(ctx)
+	}
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		fatal("Server forced to shutdown", "err", err)
 	}
 
-	log.Println("Server exited")
+	slog.Info("Server exited")
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries. It
+// never returns nil, so an empty value disables the corresponding feature.
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Sources of served bytes for goproxy_served_bytes_total
+const (
+	sourceCache    = "cache"
+	sourceUpstream = "upstream"
+)
+
+// Event metrics, updated where the events happen. Metrics derived from proxy
+// state (cache size, tiers, evictions) are collected by proxyCollector.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_requests_total",
+		Help: "Requests handled, by artifact kind and response status code.",
+	}, []string{"kind", "code"})
+
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_cache_hits_total",
+		Help: "Requests served from the cache, by artifact kind.",
+	}, []string{"kind"})
+
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_cache_misses_total",
+		Help: "Requests not served from the cache, by artifact kind.",
+	}, []string{"kind"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goproxy_upstream_request_duration_seconds",
+		Help:    "Time until an upstream answered with response headers (or failed), by upstream and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 15), // 5ms to ~80s
+	}, []string{"upstream", "outcome"})
+
+	servedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_served_bytes_total",
+		Help: "Artifact bytes sent to clients, by whether they were served from the cache or after an upstream request.",
+	}, []string{"source"})
+
+	downloadsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goproxy_downloads_in_flight",
+		Help: "Upstream fetches currently in progress, by artifact kind.",
+	}, []string{"kind"})
+
+	dnsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goproxy_dns_lookup_duration_seconds",
+		Help:    "Time to resolve a host name with the configured DNS server, by resolver type and outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14), // 1ms to ~8s
+	}, []string{"resolver", "outcome"})
+
+	dnsCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_dns_cache_hits_total",
+		Help: "Host name lookups answered from the DNS cache, including negative answers, by resolver type.",
+	}, []string{"resolver"})
+
+	dnsCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_dns_cache_misses_total",
+		Help: "Host name lookups that had to query the DNS server, by resolver type.",
+	}, []string{"resolver"})
+
+	dnsCachePrefetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_dns_cache_prefetches_total",
+		Help: "Popular DNS cache entries refreshed before they expired, by resolver type.",
+	}, []string{"resolver"})
+)
+
+// metricsHandler serves /metrics in the Prometheus exposition format
+var metricsHandler = promhttp.Handler()
+
+func init() {
+	prometheus.MustRegister(requestsTotal, cacheHits, cacheMisses, upstreamDuration, servedBytes, downloadsInFlight, dnsDuration,
+		dnsCacheHits, dnsCacheMisses, dnsCachePrefetches)
+}
+
+// outcome labels a timed operation for the duration histograms
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// statusWriter records the status code and size of a response for
+// goproxy_requests_total and the access log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's sendfile path for zips
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode returns the recorded status code
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// timedResolver observes the latency of every lookup of a DNSResolver
+type timedResolver struct {
+	ttlResolver
+	kind string // udp, doh, dot or doq
+}
+
+func (r *timedResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, host)
+	return ips, err
+}
+
+func (r *timedResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	start := time.Now()
+	ips, ttl, err := r.ttlResolver.lookupIPTTL(ctx, host)
+	dnsDuration.WithLabelValues(r.kind, outcome(err)).Observe(time.Since(start).Seconds())
+	return ips, ttl, err
+}
+
+// cacheSizeMaxAge is how long a computed cache size is reported before the
+// storage is listed again. The janitor refreshes it on every sweep.
+const cacheSizeMaxAge = time.Minute
+
+// cacheSizer remembers the total size of the cache storage, since computing
+// it means listing every entry
+type cacheSizer struct {
+	mu      sync.Mutex
+	size    int64
+	updated time.Time
+}
+
+// set records a freshly computed cache size
+func (c *cacheSizer) set(size int64) {
+	c.mu.Lock()
+	c.size, c.updated = size, time.Now()
+	c.mu.Unlock()
+}
+
+// cacheSize returns the total size of the entries in the cache storage
+func (p *Proxy) cacheSize(ctx context.Context) (int64, error) {
+	c := &p.size
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updated) < cacheSizeMaxAge {
+		return c.size, nil
+	}
+	entries, err := p.storage.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	c.size, c.updated = total, time.Now()
+	return total, nil
+}
+
+// proxyCollector exports metrics derived from the state of a Proxy
+type proxyCollector struct {
+	proxy *Proxy
+}
+
+var (
+	cacheSizeDesc = prometheus.NewDesc("goproxy_cache_size_bytes",
+		"Total size of the cache storage.", nil, nil)
+	tierHitsDesc = prometheus.NewDesc("goproxy_cache_tier_hits_total",
+		"Lookups served by a cache tier.", []string{"tier"}, nil)
+	tierMissesDesc = prometheus.NewDesc("goproxy_cache_tier_misses_total",
+		"Lookups not found in a cache tier.", []string{"tier"}, nil)
+	memoryBytesDesc = prometheus.NewDesc("goproxy_cache_memory_bytes",
+		"Size of the entries held in the memory tier.", nil, nil)
+	evictedFilesDesc = prometheus.NewDesc("goproxy_cache_evicted_files_total",
+		"Cache entries evicted by the janitor.", nil, nil)
+	evictedBytesDesc = prometheus.NewDesc("goproxy_cache_evicted_bytes_total",
+		"Bytes reclaimed by the janitor.", nil, nil)
+	verifyFailuresDesc = prometheus.NewDesc("goproxy_verify_failures_total",
+		"Downloads rejected because they did not match the checksum database.", nil, nil)
+)
+
+func (c *proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{cacheSizeDesc, tierHitsDesc, tierMissesDesc, memoryBytesDesc, evictedFilesDesc, evictedBytesDesc, verifyFailuresDesc} {
+		ch <- d
+	}
+}
+
+func (c *proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	p := c.proxy
+	if size, err := p.cacheSize(context.Background()); err == nil {
+		ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(size))
+	}
+	if p.tiered != nil {
+		memory, storage := p.tiered.stats()
+		ch <- prometheus.MustNewConstMetric(tierHitsDesc, prometheus.CounterValue, float64(memory.Hits), "memory")
+		ch <- prometheus.MustNewConstMetric(tierMissesDesc, prometheus.CounterValue, float64(memory.Misses), "memory")
+		ch <- prometheus.MustNewConstMetric(tierHitsDesc, prometheus.CounterValue, float64(storage.Hits), "storage")
+		ch <- prometheus.MustNewConstMetric(tierMissesDesc, prometheus.CounterValue, float64(storage.Misses), "storage")
+		ch <- prometheus.MustNewConstMetric(memoryBytesDesc, prometheus.GaugeValue, float64(memory.Bytes))
+	}
+	if p.janitor != nil {
+		ch <- prometheus.MustNewConstMetric(evictedFilesDesc, prometheus.CounterValue, float64(p.janitor.evictedFiles.Load()))
+		ch <- prometheus.MustNewConstMetric(evictedBytesDesc, prometheus.CounterValue, float64(p.janitor.evictedBytes.Load()))
+	}
+	if p.verifier != nil {
+		ch <- prometheus.MustNewConstMetric(verifyFailuresDesc, prometheus.CounterValue, float64(p.verifier.failures.Load()))
+	}
+}
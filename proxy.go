@@ -1,265 +1,188 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/proxy"
+	"golang.org/x/sync/singleflight"
 )
 
-// DNSResolver handles different DNS protocol types
-type DNSResolver interface {
-	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+// defaultListTTL is how long list and @latest responses are served from
+// cache before they are revalidated with upstream
+const defaultListTTL = 5 * time.Minute
+
+// Config holds the settings used to build a Proxy
+type Config struct {
+	CacheDir  string
+	Upstream  string        // GOPROXY-style list, see parseUpstreams
+	HTTPProxy string        // HTTP/HTTPS/SOCKS5 proxy URL for upstream requests
+	DNSServer string        // DNS server URL, see createDNSResolver
+	Routes    []Route       // per-module-pattern upstreams, checked in order before Upstream
+	ListTTL   time.Duration // freshness of list and @latest entries; 0 revalidates on every request
+	Offline   bool          // serve from cache only, never contacting upstream
+	Storage   Storage       // cache backend; nil means files under CacheDir
+
+	// DNSCacheMinTTL and DNSCacheMaxTTL bound how long answers of the DNS
+	// servers are cached; a zero DNSCacheMaxTTL disables the DNS cache
+	DNSCacheMinTTL time.Duration
+	DNSCacheMaxTTL time.Duration
+
+	// CacheMemorySize, if positive, is the size in bytes of an in-memory LRU
+	// tier in front of Storage for small artifacts
+	CacheMemorySize int64
+
+	// CacheMaxSize, if positive, is the cache size quota in bytes enforced by
+	// a background janitor evicting entries by CachePolicy (lru or lfu)
+	CacheMaxSize int64
+	CachePolicy  string
+	SumDBs       []string // checksum databases served under /sumdb/; nil means defaultSumDB
+
+	// Verify enables checking downloaded zips and go.mod files against the
+	// checksum database VerifyKey (GOSUMDB "name+hash+key" form, empty means
+	// defaultSumDBKey) before they are cached. Modules matching the
+	// comma-separated NoSumDB globs are not verified.
+	Verify    bool
+	VerifyKey string
+	NoSumDB   string
 }
 
-// StandardDNSResolver uses UDP DNS
-type StandardDNSResolver struct {
-	server string
-}
-
-func (r *StandardDNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{Timeout: 5 * time.Second}
-			return d.DialContext(ctx, "udp", r.server)
-		},
-	}
-	addrs, err := resolver.LookupIPAddr(ctx, host)
-	if err != nil {
-		return nil, err
-	}
-	ips := make([]net.IP, len(addrs))
-	for i, addr := range addrs {
-		ips[i] = addr.IP
-	}
-	return ips, nil
-}
-
-// DoHResolver uses DNS-over-HTTPS
-type DoHResolver struct {
-	client   *http.Client
-	endpoint string
+// Proxy handles Go module proxy requests with disk caching
+type Proxy struct {
+	cacheDir string         // local directory for repository mirrors and downloads in progress
+	storage  Storage        // cache backend for all artifacts
+	tiered   *tieredStorage // memory tier wrapping storage; nil unless configured
+	upstream *upstreamGroup // default upstreams, for modules matching no route
+	routes   []route
+	listTTL  time.Duration
+	dnsCache dnsCacheConfig  // DNS cache TTL bounds of upstream clients
+	offline  bool            // serve from cache only, see Config.Offline
+	sumDBs   map[string]bool // checksum database names served under /sumdb/
+	// sumDBProxied caches, per checksum database, whether upstream proxies it
+	sumDBProxied sync.Map
+	verifier     *verifier          // nil unless verification is enabled
+	janitor      *janitor           // nil unless a cache quota is set
+	size         cacheSizer         // last computed cache size, for metrics
+	locks        keyedMutex         // per cache key locks, see keyedMutex
+	flights      singleflight.Group // coalesces concurrent upstream fetches per cache key
 }
 
-func (r *DoHResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
-	// Simple DoH implementation using JSON format
-	dohURL := fmt.Sprintf("%s?name=%s&type=A", r.endpoint, url.QueryEscape(host))
-	req, err := http.NewRequestWithContext(ctx, "GET", dohURL, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Accept", "application/dns-json")
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return nil, err
+// NewProxy creates a new proxy instance with configured HTTP clients
+func NewProxy(cfg Config) (*Proxy, error) {
+	// Determine proxy URL: flag > HTTP_PROXY > HTTPS_PROXY > SOCKS5_PROXY
+	proxyURL := cfg.HTTPProxy
+	if proxyURL == "" {
+		proxyURL = os.Getenv("HTTP_PROXY")
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("DoH server returned status %d", resp.StatusCode)
+	if proxyURL == "" {
+		proxyURL = os.Getenv("HTTPS_PROXY")
 	}
-
-	var dohResponse struct {
-		Answer []struct {
-			Type int    `json:"type"`
-			Data string `json:"data"`
-		} `json:"Answer"`
+	if proxyURL == "" {
+		proxyURL = os.Getenv("SOCKS5_PROXY")
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&dohResponse); err != nil {
-		return nil, err
+	if cfg.ListTTL < 0 {
+		return nil, fmt.Errorf("invalid list TTL %v: must not be negative", cfg.ListTTL)
 	}
 
-	var ips []net.IP
-	for _, answer := range dohResponse.Answer {
-		if answer.Type == 1 { // A record
-			if ip := net.ParseIP(answer.Data); ip != nil {
-				ips = append(ips, ip)
-			}
-		}
+	sumDBs := make(map[string]bool)
+	for _, name := range cfg.SumDBs {
+		sumDBs[name] = true
 	}
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("no A records found for %s", host)
+	if cfg.SumDBs == nil {
+		sumDBs[defaultSumDB] = true
 	}
-	return ips, nil
-}
-
-// DoTResolver uses DNS-over-TLS
-type DoTResolver struct {
-	server string
-	client *dns.Client
-}
-
-func (r *DoTResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
 
-	// Create TLS connection
-	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", r.server, &tls.Config{
-		ServerName: strings.Split(r.server, ":")[0],
-	})
-	if err != nil {
-		return nil, err
+	storage := cfg.Storage
+	if storage == nil {
+		storage = newDiskStorage(cfg.CacheDir)
 	}
-	defer conn.Close()
-
-	dnsConn := &dns.Conn{Conn: conn}
-	defer dnsConn.Close()
 
-	// Set deadline from context
-	if deadline, ok := ctx.Deadline(); ok {
-		dnsConn.SetDeadline(deadline)
+	var tiered *tieredStorage
+	if cfg.CacheMemorySize > 0 {
+		tiered = newTieredStorage(storage, cfg.CacheMemorySize)
+		storage = tiered
 	}
 
-	err = dnsConn.WriteMsg(m)
-	if err != nil {
-		return nil, err
+	p := &Proxy{
+		cacheDir: cfg.CacheDir,
+		storage:  storage,
+		tiered:   tiered,
+		listTTL:  cfg.ListTTL,
+		dnsCache: dnsCacheConfig{minTTL: cfg.DNSCacheMinTTL, maxTTL: cfg.DNSCacheMaxTTL},
+		offline:  cfg.Offline,
+		sumDBs:   sumDBs,
 	}
 
-	reply, err := dnsConn.ReadMsg()
+	var err error
+	p.upstream, err = p.newUpstreamGroup(cfg.Upstream, proxyURL, cfg.DNSServer)
 	if err != nil {
 		return nil, err
 	}
 
-	var ips []net.IP
-	for _, rr := range reply.Answer {
-		if a, ok := rr.(*dns.A); ok {
-			ips = append(ips, a.A)
+	// Routes use only their own proxy and DNS settings, so private upstreams
+	// are not reached through the public proxy
+	for _, r := range cfg.Routes {
+		group, err := p.newUpstreamGroup(r.Upstream, r.HTTPProxy, r.DNSServer)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Patterns, err)
 		}
-	}
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("no A records found for %s", host)
-	}
-	return ips, nil
-}
-
-// DoQResolver uses DNS-over-QUIC
-type DoQResolver struct {
-	server string
-	client *dns.Client
-}
-
-func (r *DoQResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
-	// DoQ implementation using miekg/dns
-	// Note: Full DoQ support requires QUIC library
-	// For now, fallback to DoT
-	dotResolver := &DoTResolver{
-		server: r.server,
-		client: r.client,
-	}
-	return dotResolver.LookupIP(ctx, host)
-}
-
-// createDNSResolver creates appropriate DNS resolver based on URL
-func createDNSResolver(dnsURL string) (DNSResolver, error) {
-	if dnsURL == "" {
-		return nil, nil
-	}
-
-	// Check if it's a DoH URL
-	if strings.HasPrefix(dnsURL, "https://") {
-		return &DoHResolver{
-			client: &http.Client{
-				Timeout: 10 * time.Second,
-			},
-			endpoint: dnsURL,
-		}, nil
+		p.routes = append(p.routes, route{patterns: r.Patterns, group: group})
 	}
 
-	// Check if it's DoQ (quic://)
-	if strings.HasPrefix(dnsURL, "quic://") {
-		server := strings.TrimPrefix(dnsURL, "quic://")
-		if !strings.Contains(server, ":") {
-			server += ":853"
+	// Verification is asked for to be safe, so failing to set it up is
+	// fatal rather than a reason to serve unverified modules
+	if cfg.Verify {
+		key := cfg.VerifyKey
+		if key == "" {
+			key = defaultSumDBKey
 		}
-		return &DoQResolver{
-			server: server,
-			client: &dns.Client{Net: "tcp-tls"},
-		}, nil
-	}
-
-	// Check if it's DoT (tls://)
-	if strings.HasPrefix(dnsURL, "tls://") {
-		server := strings.TrimPrefix(dnsURL, "tls://")
-		if !strings.Contains(server, ":") {
-			server += ":853"
+		v, err := newVerifier(p, key, cfg.NoSumDB)
+		if err != nil {
+			return nil, fmt.Errorf("checksum verification: %v", err)
 		}
-		return &DoTResolver{
-			server: server,
-			client: &dns.Client{Net: "tcp-tls"},
-		}, nil
+		p.verifier = v
+		slog.Info("Verifying downloads against checksum database", "sumdb", v.name)
 	}
 
-	// Standard DNS (udp:// or plain IP:port)
-	server := strings.TrimPrefix(dnsURL, "udp://")
-	if !strings.Contains(server, ":") {
-		server += ":53"
-	}
-	return &StandardDNSResolver{server: server}, nil
-}
-
-// createDialer creates a custom dialer with DNS resolver support
-func createDialer(dnsResolver DNSResolver) func(ctx context.Context, network, address string) (net.Conn, error) {
-	dialer := &net.Dialer{
-		Timeout:   5 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}
-
-	if dnsResolver != nil {
-		dialer.Resolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				host, port, err := net.SplitHostPort(address)
-				if err != nil {
-					return nil, err
-				}
-				ips, err := dnsResolver.LookupIP(ctx, host)
-				if err != nil || len(ips) == 0 {
-					return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
-				}
-				// Use first IP
-				resolvedAddr := net.JoinHostPort(ips[0].String(), port)
-				d := net.Dialer{Timeout: 5 * time.Second}
-				return d.DialContext(ctx, network, resolvedAddr)
-			},
+	if cfg.CacheMaxSize > 0 {
+		j, err := newJanitor(p, cfg.CacheMaxSize, cfg.CachePolicy)
+		if err != nil {
+			return nil, err
 		}
+		p.janitor = j
+		go j.run()
 	}
 
-	return dialer.DialContext
-}
-
-// Proxy handles Go module proxy requests with disk caching
-type Proxy struct {
-	cacheDir string
-	upstream string
-	client   *http.Client
-	mu       sync.RWMutex
+	if err := prometheus.Register(&proxyCollector{proxy: p}); err != nil {
+		slog.Warn("Proxy metrics not exported", "err", err)
+	}
+	return p, nil
 }
 
-// NewProxy creates a new proxy instance with configured HTTP client
-func NewProxy(cacheDir, upstream, httpProxy, dnsServer string) *Proxy {
+// newHTTPClient creates the HTTP client used for upstream requests, which
+// connects through httpProxy (HTTP/HTTPS/SOCKS5, empty for none) and
+// resolves host names with dnsServer (see createDNSResolver), caching
+// answers as configured by dnsCache
+func newHTTPClient(httpProxy, dnsServer string, dnsCache dnsCacheConfig) *http.Client {
 	// Create DNS resolver
-	dnsResolver, err := createDNSResolver(dnsServer)
+	dnsResolver, err := createDNSResolver(dnsServer, dnsCache)
 	if err != nil {
-		log.Printf("[WARN] Failed to create DNS resolver: %v", err)
+		slog.Warn("Failed to create DNS resolver", "err", err)
 		dnsResolver = nil
 	} else if dnsResolver != nil {
-		log.Printf("Using DNS resolver: %s", dnsServer)
+		slog.Info("Using DNS resolver", "dns", dnsServer)
 	}
 
 	// Create dialer with DNS support
@@ -275,71 +198,42 @@ func NewProxy(cacheDir, upstream, httpProxy, dnsServer string) *Proxy {
 		MaxIdleConnsPerHost:   10,               // Maximum idle connections per host
 	}
 
-	// Determine proxy URL: flag > HTTP_PROXY > HTTPS_PROXY > SOCKS5_PROXY
-	proxyURL := httpProxy
-	if proxyURL == "" {
-		proxyURL = os.Getenv("HTTP_PROXY")
-	}
-	if proxyURL == "" {
-		proxyURL = os.Getenv("HTTPS_PROXY")
-	}
-	if proxyURL == "" {
-		proxyURL = os.Getenv("SOCKS5_PROXY")
-	}
-
 	// Configure proxy if provided
-	if proxyURL != "" {
-		parsedURL, err := url.Parse(proxyURL)
+	if httpProxy != "" {
+		parsedURL, err := url.Parse(httpProxy)
 		if err != nil {
-			log.Printf("[WARN] Invalid proxy URL '%s': %v", proxyURL, err)
+			slog.Warn("Invalid proxy URL", "proxy", httpProxy, "err", err)
 		} else {
 			switch parsedURL.Scheme {
 			case "http", "https":
 				// HTTP/HTTPS proxy
 				transport.Proxy = http.ProxyURL(parsedURL)
-				log.Printf("Using HTTP proxy: %s", proxyURL)
+				slog.Info("Using HTTP proxy", "proxy", httpProxy)
 			case "socks5", "socks5h":
 				// SOCKS5 proxy
 				socksDialer, err := proxy.SOCKS5("tcp", parsedURL.Host, nil, proxy.Direct)
 				if err != nil {
-					log.Printf("[WARN] Failed to create SOCKS5 dialer: %v", err)
+					slog.Warn("Failed to create SOCKS5 dialer", "err", err)
 				} else {
 					// For SOCKS5, we still want DNS resolution to use custom DNS if specified
 					if dnsResolver != nil {
-						// Create a wrapper that uses custom DNS before SOCKS5
-						transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
-							// Resolve address using custom DNS
-							host, port, err := net.SplitHostPort(address)
-							if err != nil {
-								return nil, err
-							}
-							ips, err := dnsResolver.LookupIP(ctx, host)
-							if err != nil || len(ips) == 0 {
-								return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
-							}
-							// Use first IP
-							resolvedAddr := net.JoinHostPort(ips[0].String(), port)
-							return socksDialer.(proxy.ContextDialer).DialContext(ctx, network, resolvedAddr)
-						}
+						// Resolve with custom DNS, then connect to the
+						// addresses through SOCKS5 with Happy Eyeballs
+						transport.DialContext = resolvingDialer(dnsResolver, socksDialer.(proxy.ContextDialer).DialContext)
 					} else {
 						transport.DialContext = socksDialer.(proxy.ContextDialer).DialContext
 					}
-					log.Printf("Using SOCKS5 proxy: %s", proxyURL)
+					slog.Info("Using SOCKS5 proxy", "proxy", httpProxy)
 				}
 			default:
-				log.Printf("[WARN] Unsupported proxy scheme: %s (supported: http, https, socks5, socks5h)", parsedURL.Scheme)
+				slog.Warn("Unsupported proxy scheme (supported: http, https, socks5, socks5h)", "scheme", parsedURL.Scheme)
 			}
 		}
 	}
 
-	return &Proxy{
-		cacheDir: cacheDir,
-		upstream: strings.TrimSuffix(upstream, "/"),
-		client: &http.Client{
-			Timeout:   5 * time.Minute, // Increased timeout for large files (zip downloads)
-			Transport: transport,
-		},
-		mu: sync.RWMutex{},
+	return &http.Client{
+		Timeout:   5 * time.Minute, // Increased timeout for large files (zip downloads)
+		Transport: transport,
 	}
 }
 
@@ -358,305 +252,293 @@ func (p *Proxy) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[%s] %s %s", r.RemoteAddr, r.Method, path)
+	// Prometheus metrics
+	if path == "metrics" {
+		metricsHandler.ServeHTTP(w, r)
+		return
+	}
+
+	// Every request gets an ID and exactly one access log record
+	rec := &accessRecord{id: requestID(r)}
+	w.Header().Set(requestIDHeader, rec.id)
+	r = r.WithContext(withAccess(r.Context(), rec))
+
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	start := time.Now()
+	kind := "invalid"
+	var mreq *moduleRequest
+	defer func() {
+		requestsTotal.WithLabelValues(kind, strconv.Itoa(sw.statusCode())).Inc()
+		logAccess(r, rec, sw, kind, mreq, time.Since(start))
+	}()
+
+	// Checksum database requests have their own protocol
+	if strings.HasPrefix(path, "sumdb/") {
+		kind = "sumdb"
+		p.handleSumDB(w, r, path)
+		return
+	}
 
-	// Route to appropriate handler based on path
-	if strings.HasSuffix(path, "/@v/list") {
-		p.handleList(w, r, path)
-	} else if strings.HasSuffix(path, ".info") {
-		p.handleInfo(w, r, path)
-	} else if strings.HasSuffix(path, ".mod") {
-		p.handleMod(w, r, path)
-	} else if strings.HasSuffix(path, ".zip") {
-		p.handleZip(w, r, path)
-	} else {
+	// Validate the request before anything touches the cache or upstream
+	mreq, err := parseRequest(path)
+	if errors.Is(err, errUnknownEndpoint) {
+		kind = "unknown"
 		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Warn("Rejected invalid request", "path", path, "err", err)
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	kind = mreq.Kind.String()
+	if p.janitor != nil {
+		p.janitor.touch(mreq.Key())
+	}
+
+	// Route to appropriate handler based on artifact kind
+	switch mreq.Kind {
+	case kindList:
+		p.handleList(w, r, mreq)
+	case kindLatest:
+		p.handleLatest(w, r, mreq)
+	case kindInfo:
+		p.handleInfo(w, r, mreq)
+	case kindMod:
+		p.handleMod(w, r, mreq)
+	case kindZip:
+		p.handleZip(w, r, mreq)
 	}
 }
 
+// healthResponse is the body of a health check response
+type healthResponse struct {
+	Status string `json:"status"`
+	// Cache holds the hit ratios of the memory and storage tiers, if the
+	// memory tier is enabled
+	Cache map[string]TierStats `json:"cache,omitempty"`
+}
+
 // handleHealth handles health check requests
 func (p *Proxy) handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok"}
+	if p.tiered != nil {
+		memory, storage := p.tiered.stats()
+		resp.Cache = map[string]TierStats{"memory": memory, "storage": storage}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
+	json.NewEncoder(w).Encode(resp)
 }
 
 // handleList handles GET /<module>/@v/list requests
-func (p *Proxy) handleList(w http.ResponseWriter, r *http.Request, path string) {
-	cachePath := cachePath(p.cacheDir, path)
-
-	// Try cache first (read lock)
-	p.mu.RLock()
-	cached, err := readCache(cachePath)
-	p.mu.RUnlock()
-
-	if err == nil {
-		log.Printf("[CACHE HIT] %s", path)
+func (p *Proxy) handleList(w http.ResponseWriter, r *http.Request, mreq *moduleRequest) {
+	path := mreq.Key()
+
+	// Offline, the list holds exactly the versions that can be served
+	if p.offline {
+		data, ok := p.listFromCache(r.Context(), strings.TrimSuffix(path, "list"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("Failed to fetch: %v", errOffline), http.StatusNotFound)
+			return
+		}
+		cacheResult(r.Context(), mreq.Kind.String(), path, cacheOffline)
+		servedBytes.WithLabelValues(sourceCache).Add(float64(len(data)))
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Write(cached)
+		w.Write(data)
 		return
 	}
 
-	log.Printf("[CACHE MISS] %s", path)
-
-	// Fetch from upstream
-	url := fmt.Sprintf("%s/%s", p.upstream, path)
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	data, _, err := p.fetchMutable(r.Context(), mreq, p.listTTL, nil)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
+		logFetchError(r.Context(), path, err)
+		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
 		return
 	}
 
-	resp, err := p.client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to fetch %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[ERROR] Upstream returned %d for %s", resp.StatusCode, url)
-		http.Error(w, fmt.Sprintf("Upstream error: %d", resp.StatusCode), resp.StatusCode)
-		return
-	}
+// handleLatest handles GET /<module>/@latest requests
+func (p *Proxy) handleLatest(w http.ResponseWriter, r *http.Request, mreq *moduleRequest) {
+	path := mreq.Key()
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("[ERROR] Failed to read response for %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to read response: %v", err), http.StatusInternalServerError)
-		return
+	status, err := http.StatusNotFound, errOffline
+	if !p.offline {
+		var data []byte
+		data, _, err = p.fetchMutable(r.Context(), mreq, p.listTTL, validateJSON)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+		logFetchError(r.Context(), path, err)
+
+		// 404/410 are authoritative answers: the module has no latest version
+		if isNotFound(err) {
+			http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
+			return
+		}
+		status = http.StatusBadGateway
 	}
 
-	// Cache the response (write lock)
-	p.mu.Lock()
-	if err := writeCache(cachePath, data); err != nil {
-		log.Printf("[WARN] Failed to cache %s: %v", path, err)
+	// Offline, or upstream unreachable and nothing cached: compute the
+	// newest version from cached .info files. They are immutable and
+	// committed atomically, so no locks are needed to read them.
+	data, ok := p.latestFromCache(r.Context(), strings.TrimSuffix(path, "@latest")+"@v/")
+	if !ok {
+		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), status)
+		return
 	}
-	p.mu.Unlock()
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	cacheResult(r.Context(), mreq.Kind.String(), path, cacheOffline)
+	servedBytes.WithLabelValues(sourceCache).Add(float64(len(data)))
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
 
 // handleInfo handles GET /<module>/@v/<version>.info requests
-func (p *Proxy) handleInfo(w http.ResponseWriter, r *http.Request, path string) {
-	cachePath := cachePath(p.cacheDir, path)
+func (p *Proxy) handleInfo(w http.ResponseWriter, r *http.Request, mreq *moduleRequest) {
+	path := mreq.Key()
+
+	// Queries such as "master" are resolved by upstream every time
+	cacheable := mreq.Cacheable()
 
 	// Try cache first (read lock)
-	p.mu.RLock()
-	cached, err := readCache(cachePath)
-	p.mu.RUnlock()
+	if cacheable {
+		unlock := p.locks.RLock(path)
+		cached, err := p.readCache(r.Context(), path)
+		unlock()
 
-	if err == nil {
-		log.Printf("[CACHE HIT] %s", path)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(cached)
-		return
+		if err == nil {
+			cacheResult(r.Context(), mreq.Kind.String(), path, cacheHit)
+			servedBytes.WithLabelValues(sourceCache).Add(float64(len(cached)))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(cached)
+			return
+		}
 	}
 
-	log.Printf("[CACHE MISS] %s", path)
+	cacheResult(r.Context(), mreq.Kind.String(), path, cacheMiss)
 
 	// Fetch from upstream
-	url := fmt.Sprintf("%s/%s", p.upstream, path)
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	resp, err := p.client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to fetch %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[ERROR] Upstream returned %d for %s", resp.StatusCode, url)
-		http.Error(w, fmt.Sprintf("Upstream error: %d", resp.StatusCode), resp.StatusCode)
-		return
-	}
-
-	data, err := io.ReadAll(resp.Body)
+	data, err := p.fetchAndCache(r.Context(), mreq, cacheable, validateJSON)
 	if err != nil {
-		log.Printf("[ERROR] Failed to read response for %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to read response: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Validate JSON
-	var info map[string]interface{}
-	if err := json.Unmarshal(data, &info); err != nil {
-		log.Printf("[ERROR] Invalid JSON from upstream for %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadGateway)
+		logFetchError(r.Context(), path, err)
+		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
 		return
 	}
-
-	// Cache the response (write lock)
-	p.mu.Lock()
-	if err := writeCache(cachePath, data); err != nil {
-		log.Printf("[WARN] Failed to cache %s: %v", path, err)
-	}
-	p.mu.Unlock()
+	servedBytes.WithLabelValues(sourceUpstream).Add(float64(len(data)))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
 
 // handleMod handles GET /<module>/@v/<version>.mod requests
-func (p *Proxy) handleMod(w http.ResponseWriter, r *http.Request, path string) {
-	cachePath := cachePath(p.cacheDir, path)
+func (p *Proxy) handleMod(w http.ResponseWriter, r *http.Request, mreq *moduleRequest) {
+	path := mreq.Key()
 
 	// Try cache first (read lock)
-	p.mu.RLock()
-	cached, err := readCache(cachePath)
-	p.mu.RUnlock()
+	unlock := p.locks.RLock(path)
+	cached, err := p.readCache(r.Context(), path)
+	unlock()
 
 	if err == nil {
-		log.Printf("[CACHE HIT] %s", path)
+		cacheResult(r.Context(), mreq.Kind.String(), path, cacheHit)
+		servedBytes.WithLabelValues(sourceCache).Add(float64(len(cached)))
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Write(cached)
 		return
 	}
 
-	log.Printf("[CACHE MISS] %s", path)
+	cacheResult(r.Context(), mreq.Kind.String(), path, cacheMiss)
 
 	// Fetch from upstream
-	url := fmt.Sprintf("%s/%s", p.upstream, path)
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	data, err := p.fetchAndCache(r.Context(), mreq, true, p.modValidator(mreq))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
+		logFetchError(r.Context(), path, err)
+		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
 		return
 	}
-
-	resp, err := p.client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to fetch %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[ERROR] Upstream returned %d for %s", resp.StatusCode, url)
-		http.Error(w, fmt.Sprintf("Upstream error: %d", resp.StatusCode), resp.StatusCode)
-		return
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("[ERROR] Failed to read response for %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to read response: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Cache the response (write lock)
-	p.mu.Lock()
-	if err := writeCache(cachePath, data); err != nil {
-		log.Printf("[WARN] Failed to cache %s: %v", path, err)
-	}
-	p.mu.Unlock()
+	servedBytes.WithLabelValues(sourceUpstream).Add(float64(len(data)))
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write(data)
 }
 
-// handleZip handles GET /<module>/@v/<version>.zip requests
-func (p *Proxy) handleZip(w http.ResponseWriter, r *http.Request, path string) {
-	cachePath := cachePath(p.cacheDir, path)
-
-	// Try cache first (read lock)
-	p.mu.RLock()
-	file, err := os.Open(cachePath)
-	p.mu.RUnlock()
-
-	if err == nil {
-		defer file.Close()
-		stat, err := file.Stat()
-		if err == nil {
-			log.Printf("[CACHE HIT] %s", path)
-			w.Header().Set("Content-Type", "application/zip")
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-			io.Copy(w, file)
-			return
-		}
-		file.Close()
+// modValidator returns the validation of a go.mod fetched for mreq: a check
+// against the checksum database if verification is enabled, otherwise nil
+func (p *Proxy) modValidator(mreq *moduleRequest) func([]byte) error {
+	if p.verifier == nil {
+		return nil
 	}
+	return func(data []byte) error {
+		return p.verifier.verifyMod(mreq.Module, mreq.Version, data)
+	}
+}
 
-	log.Printf("[CACHE MISS] %s", path)
-
-	// Fetch from upstream
-	// Use extended context timeout for zip files (up to 10 minutes)
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
-	defer cancel()
+// handleZip handles GET /<module>/@v/<version>.zip requests
+func (p *Proxy) handleZip(w http.ResponseWriter, r *http.Request, mreq *moduleRequest) {
+	path := mreq.Key()
 
-	url := fmt.Sprintf("%s/%s", p.upstream, path)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create request: %v", err), http.StatusInternalServerError)
+	if p.serveZip(w, r, path, sourceCache) {
+		cacheResult(r.Context(), mreq.Kind.String(), path, cacheHit)
 		return
 	}
 
-	resp, err := p.client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to fetch %s: %v", url, err)
-		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
+	cacheResult(r.Context(), mreq.Kind.String(), path, cacheMiss)
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[ERROR] Upstream returned %d for %s", resp.StatusCode, url)
-		http.Error(w, fmt.Sprintf("Upstream error: %d", resp.StatusCode), resp.StatusCode)
-		return
-	}
+	// Download into the cache (shared with concurrent requests), then serve
+	// it. A purge or eviction may remove the zip in between, in which case it
+	// is downloaded again.
+	for attempt := 0; attempt < zipDownloadAttempts; attempt++ {
+		if err := p.downloadZip(r.Context(), mreq); err != nil {
+			logFetchError(r.Context(), path, err)
+			http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
+			return
+		}
 
-	// Create cache directory for this file
-	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
-		log.Printf("[ERROR] Failed to create cache dir for %s: %v", path, err)
-		http.Error(w, fmt.Sprintf("Failed to create cache dir: %v", err), http.StatusInternalServerError)
-		return
+		// The download may have taken most of the write timeout; give the
+		// response a full one (not supported by every ResponseWriter)
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(zipServeTimeout))
+		if p.serveZip(w, r, path, sourceUpstream) {
+			return
+		}
 	}
+	http.Error(w, "Failed to read cached zip", http.StatusInternalServerError)
+}
+
+// serveZip streams a cached zip to the client, counting the bytes sent as
+// coming from source. It returns false if the zip is not in the cache.
+func (p *Proxy) serveZip(w http.ResponseWriter, r *http.Request, path, source string) bool {
+	// Hold the read lock while streaming so the entry cannot be replaced or
+	// removed underneath the client
+	unlock := p.locks.RLock(path)
+	defer unlock()
 
-	// Write to cache and response simultaneously
-	cacheFile, err := os.Create(cachePath + ".tmp")
+	file, info, err := p.storage.Get(r.Context(), path)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create cache file for %s: %v", path, err)
-		http.Error(w, fmt.Sprintf("Failed to create cache file: %v", err), http.StatusInternalServerError)
-		return
+		return false
 	}
+	defer file.Close()
 
-	// Set headers before writing
 	w.Header().Set("Content-Type", "application/zip")
-	if resp.ContentLength > 0 {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
-		log.Printf("[INFO] Downloading zip %s (size: %d bytes)", path, resp.ContentLength)
-	}
-
-	// Stream to both response and cache with buffered copy for better performance
-	multiWriter := io.MultiWriter(w, cacheFile)
-	startTime := time.Now()
-
-	// Use CopyBuffer with larger buffer for better performance on large files
-	buf := make([]byte, 64*1024) // 64KB buffer
-	bytesCopied, err := io.CopyBuffer(multiWriter, resp.Body, buf)
-	cacheFile.Close()
-
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size))
+	n, err := io.Copy(w, file)
+	servedBytes.WithLabelValues(source).Add(float64(n))
 	if err != nil {
-		log.Printf("[ERROR] Error copying zip for %s: %v (copied %d bytes in %v)", path, err, bytesCopied, time.Since(startTime))
-		// Remove partial cache file on error
-		os.Remove(cachePath + ".tmp")
-		// Note: Response may already be partially written, but that's acceptable
-		return
+		logger(r.Context()).Warn("Error sending zip", "key", path, "err", err)
 	}
+	return true
+}
 
-	log.Printf("[SUCCESS] Cached zip %s (%d bytes in %v)", path, bytesCopied, time.Since(startTime))
-
-	// Atomically rename temp file to final cache file
-	if err := os.Rename(cachePath+".tmp", cachePath); err != nil {
-		log.Printf("[WARN] Failed to rename cache file for %s: %v", path, err)
-		os.Remove(cachePath + ".tmp")
+// validateJSON rejects upstream .info and @latest bodies that are not JSON
+func validateJSON(data []byte) error {
+	var info map[string]interface{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
 	}
+	return nil
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// fakeUpstream is a module proxy serving fixed bodies by path and counting
+// the requests for each path
+type fakeUpstream struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string]string
+	hits  map[string]int
+	// handler, if set, serves the request instead of files
+	handler http.HandlerFunc
+}
+
+func newFakeUpstream(t *testing.T, files map[string]string) *fakeUpstream {
+	u := &fakeUpstream{files: files, hits: make(map[string]int)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		u.mu.Lock()
+		u.hits[path]++
+		body, ok := u.files[path]
+		handler := u.handler
+		u.mu.Unlock()
+
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// hitCount returns the number of requests upstream got for path
+func (u *fakeUpstream) hitCount(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.hits[path]
+}
+
+// newTestProxy returns a proxy caching modules of upstream in storage
+func newTestProxy(t *testing.T, upstream *fakeUpstream, storage Storage) *Proxy {
+	t.Helper()
+	return newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: storage, ListTTL: defaultListTTL})
+}
+
+// newTestProxyConfig returns a proxy configured by cfg, in a temporary cache
+// directory and, unless cfg lists some, without checksum databases
+func newTestProxyConfig(t *testing.T, cfg Config) *Proxy {
+	t.Helper()
+	cfg.CacheDir = t.TempDir()
+	if cfg.SumDBs == nil {
+		cfg.SumDBs = []string{}
+	}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatalf("NewProxy: %v", err)
+	}
+	return p
+}
+
+// get sends a GET request for path to p
+func get(p *Proxy, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.HandleRequest(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestServeFromStorage(t *testing.T) {
+	storage := newMemStorage()
+	files := map[string]string{
+		"example.com/m/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"example.com/m/@v/v1.0.0.mod":  "module example.com/m\n",
+		"example.com/m/@v/v1.0.0.zip":  "zip data",
+	}
+	for key, body := range files {
+		storage.Put(context.Background(), key, strings.NewReader(body))
+	}
+	upstream := newFakeUpstream(t, nil)
+	p := newTestProxy(t, upstream, storage)
+
+	for key, body := range files {
+		w := get(p, "/"+key)
+		if w.Code != http.StatusOK || w.Body.String() != body {
+			t.Errorf("GET %s = %d %q, want 200 %q", key, w.Code, w.Body, body)
+		}
+		if n := upstream.hitCount(key); n != 0 {
+			t.Errorf("GET %s: %d upstream requests for a cached entry", key, n)
+		}
+	}
+}
+
+func TestCacheUpstream(t *testing.T) {
+	files := map[string]string{
+		"example.com/m/@v/list":        "v1.0.0\n",
+		"example.com/m/@latest":        `{"Version":"v1.0.0"}`,
+		"example.com/m/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"example.com/m/@v/v1.0.0.mod":  "module example.com/m\n",
+		"example.com/m/@v/v1.0.0.zip":  "zip data",
+	}
+	upstream := newFakeUpstream(t, files)
+	storage := newMemStorage()
+	p := newTestProxy(t, upstream, storage)
+
+	for i := 0; i < 2; i++ {
+		for key, body := range files {
+			w := get(p, "/"+key)
+			if w.Code != http.StatusOK || w.Body.String() != body {
+				t.Errorf("GET %s = %d %q, want 200 %q", key, w.Code, w.Body, body)
+			}
+		}
+	}
+	for key, body := range files {
+		if n := upstream.hitCount(key); n != 1 {
+			t.Errorf("%s: %d upstream requests, want 1", key, n)
+		}
+		if got := string(storage.data(key)); got != body {
+			t.Errorf("%s cached as %q, want %q", key, got, body)
+		}
+	}
+
+	// A module upstream does not have is not cached
+	if w := get(p, "/example.com/missing/@v/v1.0.0.mod"); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing module = %d, want 404", w.Code)
+	}
+	if storage.data("example.com/missing/@v/v1.0.0.mod") != nil {
+		t.Errorf("missing module was cached")
+	}
+}
+
+func TestOffline(t *testing.T) {
+	storage := newMemStorage()
+	storage.Put(context.Background(), "example.com/m/@v/v1.0.0.info", strings.NewReader(`{"Version":"v1.0.0"}`))
+	storage.Put(context.Background(), "example.com/m/@v/v1.1.0.info", strings.NewReader(`{"Version":"v1.1.0"}`))
+	upstream := newFakeUpstream(t, nil)
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: storage, Offline: true})
+
+	if w := get(p, "/example.com/m/@v/list"); w.Code != http.StatusOK || w.Body.String() != "v1.0.0\nv1.1.0\n" {
+		t.Errorf("offline list = %d %q", w.Code, w.Body)
+	}
+	if w := get(p, "/example.com/m/@latest"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v1.1.0") {
+		t.Errorf("offline @latest = %d %q", w.Code, w.Body)
+	}
+	if w := get(p, "/example.com/m/@v/v1.2.0.info"); w.Code != http.StatusNotFound {
+		t.Errorf("offline uncached .info = %d, want 404", w.Code)
+	}
+	if len(upstream.hits) != 0 {
+		t.Errorf("offline proxy contacted upstream: %v", upstream.hits)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// artifactKind identifies which module proxy endpoint a request targets
+type artifactKind int
+
+const (
+	kindList artifactKind = iota
+	kindLatest
+	kindInfo
+	kindMod
+	kindZip
+)
+
+// String returns the name used for the kind in logs
+func (k artifactKind) String() string {
+	switch k {
+	case kindList:
+		return "list"
+	case kindLatest:
+		return "latest"
+	case kindInfo:
+		return "info"
+	case kindMod:
+		return "mod"
+	case kindZip:
+		return "zip"
+	default:
+		return "unknown"
+	}
+}
+
+// errUnknownEndpoint is returned for paths that are not part of the module
+// proxy protocol; they are answered with 404 so the go command falls back
+var errUnknownEndpoint = errors.New("unknown endpoint")
+
+// moduleRequest is a validated module proxy request
+type moduleRequest struct {
+	Module  string // decoded module path, e.g. github.com/Azure/sdk
+	Version string // decoded version; empty for list and latest
+	Kind    artifactKind
+	key     string // escaped cache key, identical to the upstream URL path
+}
+
+// Key returns the cache key of the requested artifact. It is also the path
+// of the artifact on an upstream proxy.
+func (m *moduleRequest) Key() string {
+	return m.key
+}
+
+// Cacheable reports whether the artifact is immutable and may be cached
+// forever. .info requests may carry a query such as a branch name, which
+// upstream has to resolve every time.
+func (m *moduleRequest) Cacheable() bool {
+	switch m.Kind {
+	case kindInfo, kindMod, kindZip:
+		return m.Version == module.CanonicalVersion(m.Version)
+	default:
+		return false
+	}
+}
+
+// parseRequest parses and validates a module proxy request path (without the
+// leading slash). It returns errUnknownEndpoint for paths that do not name a
+// proxy endpoint and a descriptive error for malformed module paths or
+// versions.
+func parseRequest(path string) (*moduleRequest, error) {
+	if escPath, ok := strings.CutSuffix(path, "/@v/list"); ok {
+		modPath, err := module.UnescapePath(escPath)
+		if err != nil {
+			return nil, err
+		}
+		key, err := listKey(modPath)
+		if err != nil {
+			return nil, err
+		}
+		return &moduleRequest{Module: modPath, Kind: kindList, key: key}, nil
+	}
+
+	if escPath, ok := strings.CutSuffix(path, "/@latest"); ok {
+		modPath, err := module.UnescapePath(escPath)
+		if err != nil {
+			return nil, err
+		}
+		key, err := latestKey(modPath)
+		if err != nil {
+			return nil, err
+		}
+		return &moduleRequest{Module: modPath, Kind: kindLatest, key: key}, nil
+	}
+
+	escPath, file, ok := strings.Cut(path, "/@v/")
+	if !ok || strings.Contains(file, "/") {
+		return nil, errUnknownEndpoint
+	}
+
+	var kind artifactKind
+	var ext string
+	switch {
+	case strings.HasSuffix(file, ".info"):
+		kind, ext = kindInfo, ".info"
+	case strings.HasSuffix(file, ".mod"):
+		kind, ext = kindMod, ".mod"
+	case strings.HasSuffix(file, ".zip"):
+		kind, ext = kindZip, ".zip"
+	default:
+		return nil, errUnknownEndpoint
+	}
+
+	modPath, err := module.UnescapePath(escPath)
+	if err != nil {
+		return nil, err
+	}
+	version, err := module.UnescapeVersion(strings.TrimSuffix(file, ext))
+	if err != nil {
+		return nil, err
+	}
+
+	// .mod and .zip must name a canonical version that matches the major
+	// version suffix of the module path
+	if kind != kindInfo {
+		if err := module.Check(modPath, version); err != nil {
+			return nil, err
+		}
+		if version != module.CanonicalVersion(version) {
+			return nil, fmt.Errorf("version %q is not canonical", version)
+		}
+	}
+
+	key, err := versionKey(modPath, version, ext)
+	if err != nil {
+		return nil, err
+	}
+	return &moduleRequest{Module: modPath, Version: version, Kind: kind, key: key}, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	for _, tt := range []struct {
+		path    string
+		kind    artifactKind
+		module  string
+		version string
+		err     error // errUnknownEndpoint, errInvalid or nil
+	}{
+		{path: "example.com/m/@v/list", kind: kindList, module: "example.com/m"},
+		{path: "example.com/m/@latest", kind: kindLatest, module: "example.com/m"},
+		{path: "example.com/m/@v/v1.0.0.info", kind: kindInfo, module: "example.com/m", version: "v1.0.0"},
+		{path: "example.com/m/@v/master.info", kind: kindInfo, module: "example.com/m", version: "master"},
+		{path: "example.com/m/@v/v1.0.0.mod", kind: kindMod, module: "example.com/m", version: "v1.0.0"},
+		{path: "example.com/m/@v/v1.0.0.zip", kind: kindZip, module: "example.com/m", version: "v1.0.0"},
+		{path: "github.com/!azure/sdk/@v/v1.0.0-!r!c1.zip", kind: kindZip, module: "github.com/Azure/sdk", version: "v1.0.0-RC1"},
+		{path: "example.com/m/v2/@v/v2.0.0.mod", kind: kindMod, module: "example.com/m/v2", version: "v2.0.0"},
+
+		// Not part of the protocol
+		{path: "", err: errUnknownEndpoint},
+		{path: "example.com/m", err: errUnknownEndpoint},
+		{path: "example.com/m/@v/", err: errUnknownEndpoint},
+		{path: "example.com/m/@v/v1.0.0.tar", err: errUnknownEndpoint},
+		{path: "example.com/m/@v/v1.0.0/x.zip", err: errUnknownEndpoint},
+		{path: "example.com/m/@v/list.meta", err: errUnknownEndpoint},
+		{path: "example.com/m/@v/v1.0.0.info.meta", err: errUnknownEndpoint},
+		{path: "sumdb-verifier/sum.golang.org/latest", err: errUnknownEndpoint},
+
+		// Malformed module paths and versions
+		{path: "../etc/@v/list", err: errInvalid},
+		{path: "example.com/../../etc/@v/list", err: errInvalid},
+		{path: "example.com/m/@v/../../../x.zip", err: errUnknownEndpoint},
+		{path: "example.com/m/@v/..%2f..%2fx.zip", err: errInvalid},
+		{path: "/etc/passwd/@v/list", err: errInvalid},
+		{path: `example.com\m/@v/list`, err: errInvalid},
+		{path: "example.com/m\x00/@v/list", err: errInvalid},
+		{path: "example.com/m/@v/v1.0.0\x00.zip", err: errInvalid},
+		{path: "github.com/Azure/sdk/@v/list", err: errInvalid},
+		{path: "example.com/m/@v/v1.0.0-RC1.zip", err: errInvalid},
+		{path: ".vcs/example.com/m/@v/list", err: errInvalid},
+		{path: "example.com/.vcs/@v/list", err: errInvalid},
+		{path: "sumdb-verifier/m/@v/list", err: errInvalid},
+		{path: "example.com/m/@v/v1.0.zip", err: errInvalid},
+		{path: "example.com/m/@v/master.zip", err: errInvalid},
+		{path: "example.com/m/@v/v2.0.0.mod", err: errInvalid},
+		{path: "example.com/m/v2/@v/v1.0.0.mod", err: errInvalid},
+	} {
+		mreq, err := parseRequest(tt.path)
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("parseRequest(%q): %v", tt.path, err)
+		case tt.err == errUnknownEndpoint && !errors.Is(err, errUnknownEndpoint):
+			t.Errorf("parseRequest(%q): err = %v, want errUnknownEndpoint", tt.path, err)
+		case tt.err == errInvalid && (err == nil || errors.Is(err, errUnknownEndpoint)):
+			t.Errorf("parseRequest(%q): err = %v, want a validation error", tt.path, err)
+		case tt.err == nil:
+			if mreq.Kind != tt.kind || mreq.Module != tt.module || mreq.Version != tt.version {
+				t.Errorf("parseRequest(%q) = %v %q %q, want %v %q %q", tt.path, mreq.Kind, mreq.Module, mreq.Version, tt.kind, tt.module, tt.version)
+			}
+			// The key is the request path, so upstream and cache agree
+			if mreq.Key() != tt.path {
+				t.Errorf("parseRequest(%q).Key() = %q", tt.path, mreq.Key())
+			}
+		}
+	}
+}
+
+// errInvalid stands for any error of parseRequest but errUnknownEndpoint
+var errInvalid = errors.New("invalid")
+
+func TestCachePath(t *testing.T) {
+	base := t.TempDir()
+	for _, tt := range []struct {
+		key string
+		ok  bool
+	}{
+		{"example.com/m/@v/list", true},
+		{"example.com/m/@v/v1.0.0.zip", true},
+		{"github.com/!azure/sdk/@v/v1.0.0.mod.meta", true},
+		{"sumdb-verifier/sum.golang.org/latest", true},
+		{"", false},
+		{"..", false},
+		{"../x", false},
+		{"example.com/../../x", false},
+		{"/etc/passwd", false},
+		{`example.com\..\..\x`, false},
+		{`example.com\m`, false},
+		{"example.com/m\x00", false},
+	} {
+		path, err := cachePath(base, tt.key)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("cachePath(%q) = %q, want an error", tt.key, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cachePath(%q): %v", tt.key, err)
+			continue
+		}
+		if want := filepath.Join(base, filepath.FromSlash(tt.key)); path != want {
+			t.Errorf("cachePath(%q) = %q, want %q", tt.key, path, want)
+		}
+	}
+}
+
+func TestHandleInvalidRequest(t *testing.T) {
+	// Entries that are not module artifacts must never be served
+	storage := newMemStorage()
+	secret := "not for clients"
+	for _, key := range []string{
+		"example.com/m/@v/list.meta",
+		"example.com/m/@v/v1.0.0.info.meta",
+		".vcs/example.com/m/@v/list",
+		"sumdb-verifier/m/@v/list",
+		"sumdb-verifier/sum.golang.org/latest",
+	} {
+		storage.Put(context.Background(), key, strings.NewReader(secret))
+	}
+	upstream := newFakeUpstream(t, nil)
+	p := newTestProxy(t, upstream, storage)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/example.com/m", http.StatusNotFound},
+		{"/example.com/m/@v/v1.0.0.tar", http.StatusNotFound},
+		{"/example.com/m/@v/list.meta", http.StatusNotFound},
+		{"/example.com/m/@v/v1.0.0.info.meta", http.StatusNotFound},
+		{"/sumdb-verifier/sum.golang.org/latest", http.StatusNotFound},
+		{"/.vcs/example.com/m/@v/list", http.StatusBadRequest},
+		{"/sumdb-verifier/m/@v/list", http.StatusBadRequest},
+		{"/example.com/../../etc/@v/list", http.StatusBadRequest},
+		{"/example.com/m/@v/..%2f..%2fx.zip", http.StatusNotFound},
+		{"/example.com%5cm/@v/list", http.StatusBadRequest},
+		{"/example.com/m%00/@v/list", http.StatusBadRequest},
+		{"/github.com/Azure/sdk/@v/list", http.StatusBadRequest},
+		{"/example.com/m/@v/master.zip", http.StatusBadRequest},
+	} {
+		w := get(p, tt.path)
+		if w.Code != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.status)
+		}
+		if strings.Contains(w.Body.String(), secret) {
+			t.Errorf("GET %s served a storage entry that is not an artifact", tt.path)
+		}
+	}
+	if len(upstream.hits) != 0 {
+		t.Errorf("invalid requests reached upstream: %v", upstream.hits)
+	}
+}
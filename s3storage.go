@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize is the multipart upload part size for entries of unknown size.
+// Without it the client buffers parts sized for the maximum object size.
+const s3PartSize = 16 << 20
+
+// S3Config holds the settings of an S3-compatible storage backend
+type S3Config struct {
+	Endpoint string // host[:port], e.g. s3.amazonaws.com or minio:9000
+	Bucket   string
+	Prefix   string // prepended to every cache key, e.g. "goproxy/"
+	Region   string
+	Insecure bool // use http instead of https
+}
+
+// s3Storage stores cache entries as objects in an S3-compatible bucket. The
+// object key is the cache key with an optional prefix, so the bucket has the
+// same layout as the disk cache and several proxy replicas can share it.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newS3Storage connects to the bucket described by cfg and checks that it
+// exists. Credentials come from the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY
+// or MINIO_ROOT_USER/MINIO_ROOT_PASSWORD environment variables, or from the
+// instance role.
+func newS3Storage(ctx context.Context, cfg S3Config) (*s3Storage, error) {
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("checking bucket %s: %v", cfg.Bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("bucket %s does not exist", cfg.Bucket)
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+// s3Error maps a missing object to fs.ErrNotExist
+func s3Error(key string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, StorageInfo{}, s3Error(key, err)
+	}
+	// GetObject is lazy; Stat sends the request
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, StorageInfo{}, s3Error(key, err)
+	}
+	return obj, StorageInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader) error {
+	// A single PUT is atomic; multipart uploads only become visible once
+	// they are completed
+	size := int64(-1)
+	switch r := r.(type) {
+	case *bytes.Reader:
+		size = int64(r.Len())
+	case *os.File:
+		if stat, err := r.Stat(); err == nil {
+			if pos, err := r.Seek(0, io.SeekCurrent); err == nil {
+				size = stat.Size() - pos
+			}
+		}
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, r, size, minio.PutObjectOptions{
+		ContentType: contentType(key),
+		PartSize:    s3PartSize,
+	})
+	return err
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return StorageInfo{}, s3Error(key, err)
+	}
+	return StorageInfo{Key: key, Size: stat.Size, ModTime: stat.LastModified}, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	var entries []StorageInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		entries = append(entries, StorageInfo{
+			Key:     strings.TrimPrefix(obj.Key, s.prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return entries, nil
+}
+
+// contentType returns the Content-Type stored with the object for key, so
+// the bucket can also be browsed or served directly
+func contentType(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".zip"):
+		return "application/zip"
+	case strings.HasSuffix(key, ".info"), strings.HasSuffix(key, "/@latest"), strings.HasSuffix(key, ".meta"):
+		return "application/json"
+	case strings.HasSuffix(key, ".mod"), strings.HasSuffix(key, "/@v/list"):
+		return "text/plain; charset=utf-8"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// TestS3Storage runs against the bucket S3_BUCKET (default goproxy-test,
+// created if missing) at S3_ENDPOINT, e.g. the minio service of
+// docker-compose.yml. It is skipped unless S3_ENDPOINT is set.
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_ENDPOINT not set")
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		bucket = "goproxy-test"
+	}
+	insecure := os.Getenv("S3_INSECURE")
+	cfg := S3Config{
+		Endpoint: endpoint,
+		Bucket:   bucket,
+		Region:   os.Getenv("S3_REGION"),
+		Insecure: insecure == "1" || strings.EqualFold(insecure, "true"),
+	}
+
+	ctx := context.Background()
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}}),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := client.BucketExists(ctx, bucket); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every run uses its own prefix and removes its objects
+	cfg.Prefix = fmt.Sprintf("/goproxy-test-%d/", time.Now().UnixNano())
+	prefix := strings.Trim(cfg.Prefix, "/") + "/"
+	t.Cleanup(func() {
+		for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			client.RemoveObject(ctx, bucket, obj.Key, minio.RemoveObjectOptions{})
+		}
+	})
+
+	s, err := newS3Storage(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+
+	// Objects are stored under the prefix, and only those are listed
+	key := "example.com/m/@v/v1.0.0.mod"
+	if _, err := client.StatObject(ctx, bucket, prefix+key, minio.StatObjectOptions{}); err != nil {
+		t.Errorf("%s not stored under the prefix %s: %v", key, prefix, err)
+	}
+	if _, err := client.StatObject(ctx, bucket, key, minio.StatObjectOptions{}); err == nil {
+		t.Errorf("%s stored without the prefix", key)
+	}
+	// An object next to the prefix is not part of the storage
+	sibling := strings.TrimSuffix(prefix, "/") + "x/example.com/m/@v/list"
+	t.Cleanup(func() { client.RemoveObject(ctx, bucket, sibling, minio.RemoveObjectOptions{}) })
+	if _, err := client.PutObject(ctx, bucket, sibling, strings.NewReader("v1.0.0\n"), -1, minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	sort.Strings(keys)
+	want := []string{"example.com/m/@v/list", key, "example.com/other/@v/list"}
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("List(\"\") = %v, want %v", keys, want)
+	}
+}
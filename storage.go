@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is a cache backend. Keys are the slash-separated cache keys built
+// by listKey, latestKey and versionKey (plus sumdb/... for checksum database
+// tiles and ".meta" sidecars). Missing entries are reported with an error
+// for which errors.Is(err, fs.ErrNotExist) holds.
+//
+// Storage does no locking of its own beyond making Put atomic; the proxy
+// serializes writers and readers of a key with its keyedMutex.
+type Storage interface {
+	// Get opens the entry for key for streaming. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error)
+	// Put stores everything read from r under key. Readers see either the
+	// previous entry or the complete new one, never a partial write.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Stat returns the size and modification time of the entry for key
+	Stat(ctx context.Context, key string) (StorageInfo, error)
+	// Delete removes the entry for key
+	Delete(ctx context.Context, key string) error
+	// List returns all entries whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]StorageInfo, error)
+}
+
+// StorageInfo describes a cache entry
+type StorageInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// diskStorage stores cache entries as files under a directory, using the
+// cache key as the relative path. Writes go to a unique temp file that is
+// renamed into place. Files and directories whose names start with "." (such
+// as the .vcs mirrors) and temp files are not part of the storage.
+type diskStorage struct {
+	dir string
+}
+
+// newDiskStorage creates a Storage backed by the directory dir
+func newDiskStorage(dir string) *diskStorage {
+	return &diskStorage{dir: dir}
+}
+
+func (d *diskStorage) Get(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error) {
+	path, err := cachePath(d.dir, key)
+	if err != nil {
+		return nil, StorageInfo{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, StorageInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, StorageInfo{}, err
+	}
+	return file, StorageInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (d *diskStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := cachePath(d.dir, key)
+	if err != nil {
+		return err
+	}
+	// Create directory if needed
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write atomically using a unique temp file, so concurrent writers of the
+	// same path never interleave
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	// Use CopyBuffer with larger buffer for better performance on large files
+	buf := make([]byte, 64*1024) // 64KB buffer
+	if _, err := io.CopyBuffer(tmp, r, buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *diskStorage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	path, err := cachePath(d.dir, key)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (d *diskStorage) Delete(ctx context.Context, key string) error {
+	path, err := cachePath(d.dir, key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (d *diskStorage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	// Walk only the directory holding the prefix
+	root := d.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if root, err = cachePath(d.dir, prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []StorageInfo
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed while walking
+			return nil
+		}
+		entries = append(entries, StorageInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return entries, err
+}
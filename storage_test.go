@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStorage is a Storage keeping entries in memory, for handler tests
+type memStorage struct {
+	mu      sync.Mutex
+	entries map[string]memEntry
+}
+
+type memEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{entries: make(map[string]memEntry)}
+}
+
+func (m *memStorage) Get(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, StorageInfo{}, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(e.data)), m.info(key, e), nil
+}
+
+func (m *memStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memEntry{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *memStorage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return StorageInfo{}, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return m.info(key, e), nil
+}
+
+func (m *memStorage) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[key]; !ok {
+		return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memStorage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []StorageInfo
+	for key, e := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, m.info(key, e))
+		}
+	}
+	return entries, nil
+}
+
+func (m *memStorage) info(key string, e memEntry) StorageInfo {
+	return StorageInfo{Key: key, Size: int64(len(e.data)), ModTime: e.modTime}
+}
+
+// data returns the entry for key, or nil
+func (m *memStorage) data(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[key].data
+}
+
+// testStorage checks the Storage contract on an empty storage s
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	key := "example.com/m/@v/v1.0.0.zip"
+
+	if _, _, err := s.Get(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get of a missing entry: err = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := s.Stat(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing entry: err = %v, want fs.ErrNotExist", err)
+	}
+
+	for k, v := range map[string]string{
+		key:                           "zip",
+		"example.com/m/@v/v1.0.0.mod": "module example.com/m\n",
+		"example.com/m/@v/list":       "v1.0.0\n",
+		"example.com/other/@v/list":   "v2.0.0\n",
+	} {
+		if err := s.Put(ctx, k, strings.NewReader(v)); err != nil {
+			t.Fatalf("Put(%s): %v", k, err)
+		}
+	}
+	// Replacing an entry
+	if err := s.Put(ctx, key, strings.NewReader("new zip")); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+
+	r, info, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "new zip" {
+		t.Errorf("Get = %q, %v; want %q", data, err, "new zip")
+	}
+	if info.Key != key || info.Size != int64(len("new zip")) {
+		t.Errorf("Get info = %+v", info)
+	}
+	if info, err := s.Stat(ctx, key); err != nil || info.Size != int64(len("new zip")) || info.ModTime.IsZero() {
+		t.Errorf("Stat = %+v, %v", info, err)
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"example.com/m/", []string{"example.com/m/@v/list", "example.com/m/@v/v1.0.0.mod", key}},
+		{"example.com/m/@v/v1", []string{"example.com/m/@v/v1.0.0.mod", key}},
+		{"example.com/o", []string{"example.com/other/@v/list"}},
+		{"missing.com/", nil},
+	} {
+		entries, err := s.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", tt.prefix, err)
+		}
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, keys, tt.want)
+		}
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Stat(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Delete: err = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestDiskStorage(t *testing.T) {
+	testStorage(t, newDiskStorage(t.TempDir()))
+}
+
+func TestMemStorage(t *testing.T) {
+	testStorage(t, newMemStorage())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// defaultSumDB is the checksum database proxied when none is configured
+const defaultSumDB = "sum.golang.org"
+
+// tilePattern matches the tile paths of the checksum database protocol:
+// tile/<H>/<L>/<NNN>[.p/<W>], where L is a level number or "data" and NNN
+// may be split into x-prefixed path elements (e.g. x001/234)
+var tilePattern = regexp.MustCompile(`^tile/[0-9]+/(?:[0-9]+|data)/(?:x[0-9]{3}/)*[0-9]{3}(?:\.p/[0-9]+)?$`)
+
+// handleSumDB handles GET /sumdb/<name>/... requests. It answers
+// "supported" for the configured checksum databases and passes "latest",
+// "lookup" and "tile" requests through, see sumDBURL. Tiles are immutable and
+// cached on disk like module zips; everything else changes as the log grows
+// and is never cached. In offline mode only cached tiles are served.
+func (p *Proxy) handleSumDB(w http.ResponseWriter, r *http.Request, path string) {
+	name, rest, ok := strings.Cut(strings.TrimPrefix(path, "sumdb/"), "/")
+	if !ok || !p.sumDBs[name] {
+		// Unknown databases get 404 so the go command connects directly
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case p.offline && !tilePattern.MatchString(rest):
+		// Only cached tiles can be served without upstream
+		http.Error(w, fmt.Sprintf("Not found: %v", errOffline), http.StatusNotFound)
+	case rest == "supported":
+		w.WriteHeader(http.StatusOK)
+	case rest == "latest":
+		p.passSumDB(w, r, name, rest)
+	case strings.HasPrefix(rest, "lookup/"):
+		if err := checkLookupPath(strings.TrimPrefix(rest, "lookup/")); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		p.passSumDB(w, r, name, rest)
+	case tilePattern.MatchString(rest):
+		p.handleTile(w, r, name, rest)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// checkLookupPath validates the escaped <module>@<version> of a lookup request
+func checkLookupPath(escaped string) error {
+	i := strings.LastIndex(escaped, "@")
+	if i < 0 {
+		return fmt.Errorf("missing @version in %q", escaped)
+	}
+	if _, err := module.UnescapePath(escaped[:i]); err != nil {
+		return err
+	}
+	_, err := module.UnescapeVersion(escaped[i+1:])
+	return err
+}
+
+// sumDBURL returns the URL to fetch path of the checksum database name from.
+// Like the go command, it prefers the /sumdb/<name>/ of the first upstream
+// that reports it as supported, which keeps sumdb traffic on the same route
+// as module downloads; otherwise it connects to https://<name>/.
+func (p *Proxy) sumDBURL(ctx context.Context, name, path string) string {
+	base, ok := p.sumDBProxied.Load(name)
+	if !ok {
+		base = "https://" + name
+		definitive := true
+		for _, u := range p.upstream.upstreams {
+			if u.url == directUpstream {
+				continue
+			}
+			resp, err := p.upstream.openURL(ctx, fmt.Sprintf("%s/sumdb/%s/supported", u.url, name), nil)
+			if err == nil {
+				resp.Body.Close()
+				base = fmt.Sprintf("%s/sumdb/%s", u.url, name)
+				break
+			}
+			if !isNotFound(err) {
+				// Retry the probe next time rather than remembering a network error
+				definitive = false
+				break
+			}
+		}
+		if definitive {
+			p.sumDBProxied.Store(name, base)
+		}
+	}
+	return fmt.Sprintf("%s/%s", base, path)
+}
+
+// passSumDB streams an uncached checksum database response to the client
+func (p *Proxy) passSumDB(w http.ResponseWriter, r *http.Request, name, path string) {
+	url := p.sumDBURL(r.Context(), name, path)
+	resp, err := p.upstream.openURL(r.Context(), url, nil)
+	if err != nil {
+		logFetchError(r.Context(), url, err)
+		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, resp.Body)
+}
+
+// handleTile serves a checksum database tile, fetching and caching it on a miss
+func (p *Proxy) handleTile(w http.ResponseWriter, r *http.Request, name, path string) {
+	key := "sumdb/" + name + "/" + path
+
+	if p.janitor != nil {
+		p.janitor.touch(key)
+	}
+
+	// Try cache first (read lock)
+	unlock := p.locks.RLock(key)
+	cached, err := p.readCache(r.Context(), key)
+	unlock()
+
+	if err == nil {
+		cacheResult(r.Context(), "sumdb", key, cacheHit)
+		servedBytes.WithLabelValues(sourceCache).Add(float64(len(cached)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(cached)
+		return
+	}
+
+	cacheResult(r.Context(), "sumdb", key, cacheMiss)
+
+	v, err := p.coalesce(r.Context(), key, func() (interface{}, error) {
+		// A fetch that finished after the cache miss above, but before this
+		// one started, may have cached the tile already
+		unlock := p.locks.RLock(key)
+		cached, err := p.readCache(r.Context(), key)
+		unlock()
+		if err == nil {
+			return cached, nil
+		}
+
+		if p.offline {
+			return nil, errOffline
+		}
+		inFlight := downloadsInFlight.WithLabelValues("sumdb")
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		ctx := context.WithoutCancel(r.Context())
+		resp, err := p.upstream.openURL(ctx, p.sumDBURL(ctx, name, path), nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		// Cache the tile (write lock)
+		unlock = p.locks.Lock(key)
+		if err := p.writeCache(ctx, key, data); err != nil {
+			logger(ctx).Warn("Failed to cache", "key", key, "err", err)
+		}
+		unlock()
+		return data, nil
+	})
+	if err != nil {
+		logFetchError(r.Context(), key, err)
+		http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), errorStatus(err))
+		return
+	}
+
+	data := v.([]byte)
+	servedBytes.WithLabelValues(sourceUpstream).Add(float64(len(data)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestSumDB(t *testing.T) {
+	files := map[string]string{
+		"sumdb/sum.test/supported":                   "",
+		"sumdb/sum.test/latest":                      "tree",
+		"sumdb/sum.test/lookup/example.com/m@v1.0.0": "record",
+		"sumdb/sum.test/tile/8/0/000":                "tile",
+		"sumdb/sum.test/tile/8/0/x001/234.p/5":       "partial tile",
+		"sumdb/sum.test/tile/8/data/000":             "data tile",
+		"sumdb/sum.other/supported":                  "",
+	}
+	upstream := newFakeUpstream(t, files)
+	storage := newMemStorage()
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: storage, SumDBs: []string{"sum.test"}})
+
+	for _, tt := range []struct {
+		path   string
+		code   int
+		hits   int  // upstream requests after two GETs
+		cached bool // whether the response is cached
+	}{
+		{"sumdb/sum.test/supported", http.StatusOK, 0, false},
+		{"sumdb/sum.other/supported", http.StatusNotFound, 0, false},
+		{"sumdb/sum.test/latest", http.StatusOK, 2, false},
+		{"sumdb/sum.test/lookup/example.com/m@v1.0.0", http.StatusOK, 2, false},
+		{"sumdb/sum.test/tile/8/0/000", http.StatusOK, 1, true},
+		{"sumdb/sum.test/tile/8/0/x001/234.p/5", http.StatusOK, 1, true},
+		{"sumdb/sum.test/tile/8/data/000", http.StatusOK, 1, true},
+		// Invalid requests never reach upstream
+		{"sumdb/sum.test/lookup/example.com/m", http.StatusBadRequest, 0, false},
+		{"sumdb/sum.test/lookup/Example.com/m@v1.0.0", http.StatusBadRequest, 0, false},
+		{"sumdb/sum.test/lookup/example.com/m@V1.0.0", http.StatusBadRequest, 0, false},
+		{"sumdb/sum.test/tile/8/0/00", http.StatusNotFound, 0, false},
+		{"sumdb/sum.test/tile/8/0/000.p/", http.StatusNotFound, 0, false},
+		{"sumdb/sum.test/other", http.StatusNotFound, 0, false},
+	} {
+		for i := 0; i < 2; i++ {
+			w := get(p, "/"+tt.path)
+			if w.Code != tt.code || (tt.code == http.StatusOK && w.Body.String() != files[tt.path]) {
+				t.Errorf("GET %s = %d %q, want %d %q", tt.path, w.Code, w.Body, tt.code, files[tt.path])
+			}
+		}
+		if hits := upstream.hitCount(tt.path); hits != tt.hits {
+			t.Errorf("GET %s twice: %d upstream requests, want %d", tt.path, hits, tt.hits)
+		}
+		if cached := storage.data(tt.path) != nil; cached != tt.cached {
+			t.Errorf("GET %s: cached = %v, want %v", tt.path, cached, tt.cached)
+		}
+	}
+
+	// Offline, only cached tiles are served
+	offline := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: storage, SumDBs: []string{"sum.test"}, Offline: true})
+	for path, code := range map[string]int{
+		"sumdb/sum.test/tile/8/0/000":                http.StatusOK,
+		"sumdb/sum.test/tile/8/1/000":                http.StatusNotFound,
+		"sumdb/sum.test/latest":                      http.StatusNotFound,
+		"sumdb/sum.test/lookup/example.com/m@v1.0.0": http.StatusNotFound,
+	} {
+		if w := get(offline, "/"+path); w.Code != code {
+			t.Errorf("offline GET %s = %d, want %d", path, w.Code, code)
+		}
+	}
+}
+
+func TestSumDBURL(t *testing.T) {
+	// Only the second upstream proxies the checksum database
+	plain := newFakeUpstream(t, nil)
+	proxying := newFakeUpstream(t, map[string]string{"sumdb/sum.test/supported": ""})
+	p := newTestProxyConfig(t, Config{Upstream: plain.URL + "," + proxying.URL + ",direct"})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if url, want := p.sumDBURL(ctx, "sum.test", "latest"), proxying.URL+"/sumdb/sum.test/latest"; url != want {
+			t.Errorf("sumDBURL = %s, want %s", url, want)
+		}
+	}
+	// The answer is remembered
+	if hits := proxying.hitCount("sumdb/sum.test/supported"); hits != 1 {
+		t.Errorf("%d probes of upstream support, want 1", hits)
+	}
+
+	// Without upstream support, the database is contacted directly
+	if url, want := p.sumDBURL(ctx, "sum.other", "latest"), "https://sum.other/latest"; url != want {
+		t.Errorf("sumDBURL = %s, want %s", url, want)
+	}
+
+	// A failed probe is not remembered
+	down := newFakeUpstream(t, nil)
+	down.Close()
+	p = newTestProxyConfig(t, Config{Upstream: down.URL + "|" + proxying.URL})
+	if url, want := p.sumDBURL(ctx, "sum.test", "latest"), "https://sum.test/latest"; url != want {
+		t.Errorf("sumDBURL with a failing upstream = %s, want %s", url, want)
+	}
+	if _, ok := p.sumDBProxied.Load("sum.test"); ok {
+		t.Errorf("result of a failed probe remembered")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryTierMaxEntry is the largest entry kept in the memory tier. Zips are
+// never kept there; this bounds the rare huge go.mod or list.
+const memoryTierMaxEntry = 256 << 10
+
+// tieredStorage is a bounded in-memory LRU tier in front of another Storage.
+// It holds the small, constantly read artifacts (.info, .mod, lists, @latest,
+// sidecars and checksum database tiles) and is populated on both reads and
+// writes. Zips bypass it. Entries are dropped from memory whenever they are
+// replaced or deleted through it, so janitor eviction invalidates both tiers.
+type tieredStorage struct {
+	next    Storage
+	maxSize int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *memoryEntry, most recently used first
+	items map[string]*list.Element
+	size  int64
+	// gen is bumped on every write or delete. A read that misses the memory
+	// tier only populates it if gen did not change while the entry was read
+	// from the next tier, so a slow read can never cache stale data.
+	gen uint64
+
+	memory  tierStats
+	backend tierStats
+}
+
+// memoryEntry is a cache entry held in the memory tier
+type memoryEntry struct {
+	key     string
+	data    []byte
+	modTime time.Time
+}
+
+// tierStats counts lookups served by one cache tier
+type tierStats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// TierStats is a snapshot of a cache tier's counters
+type TierStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+	Entries  int     `json:"entries,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+}
+
+// snapshot returns the current counters and hit ratio
+func (s *tierStats) snapshot() TierStats {
+	st := TierStats{Hits: s.hits.Load(), Misses: s.misses.Load()}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// newTieredStorage puts a memory tier of at most maxSize bytes in front of next
+func newTieredStorage(next Storage, maxSize int64) *tieredStorage {
+	return &tieredStorage{
+		next:    next,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// memoryCacheable reports whether the entry for key may be kept in memory
+func memoryCacheable(key string) bool {
+	return !strings.HasSuffix(key, ".zip")
+}
+
+func (t *tieredStorage) Get(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error) {
+	if !memoryCacheable(key) {
+		return t.getNext(ctx, key)
+	}
+
+	t.mu.Lock()
+	if elem, ok := t.items[key]; ok {
+		t.lru.MoveToFront(elem)
+		e := elem.Value.(*memoryEntry)
+		t.mu.Unlock()
+		t.memory.hits.Add(1)
+		info := StorageInfo{Key: key, Size: int64(len(e.data)), ModTime: e.modTime}
+		return io.NopCloser(bytes.NewReader(e.data)), info, nil
+	}
+	gen := t.gen
+	t.mu.Unlock()
+	t.memory.misses.Add(1)
+
+	r, info, err := t.getNext(ctx, key)
+	if err != nil || info.Size > memoryTierMaxEntry {
+		return r, info, err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, StorageInfo{}, err
+	}
+	t.add(key, data, info.ModTime, gen)
+	return io.NopCloser(bytes.NewReader(data)), info, nil
+}
+
+// getNext reads an entry from the next tier, counting hits and misses
+func (t *tieredStorage) getNext(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error) {
+	r, info, err := t.next.Get(ctx, key)
+	switch {
+	case err == nil:
+		t.backend.hits.Add(1)
+	case errors.Is(err, fs.ErrNotExist):
+		t.backend.misses.Add(1)
+	}
+	return r, info, err
+}
+
+func (t *tieredStorage) Put(ctx context.Context, key string, r io.Reader) error {
+	if !memoryCacheable(key) {
+		t.remove(key)
+		return t.next.Put(ctx, key, r)
+	}
+
+	// Small artifacts are written from memory anyway
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	gen := t.remove(key)
+	if err := t.next.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	t.add(key, data, time.Now(), gen)
+	return nil
+}
+
+func (t *tieredStorage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	t.mu.Lock()
+	if elem, ok := t.items[key]; ok {
+		e := elem.Value.(*memoryEntry)
+		t.mu.Unlock()
+		return StorageInfo{Key: key, Size: int64(len(e.data)), ModTime: e.modTime}, nil
+	}
+	t.mu.Unlock()
+	return t.next.Stat(ctx, key)
+}
+
+func (t *tieredStorage) Delete(ctx context.Context, key string) error {
+	t.remove(key)
+	return t.next.Delete(ctx, key)
+}
+
+func (t *tieredStorage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	return t.next.List(ctx, prefix)
+}
+
+// add stores data as the memory entry for key if nothing was written or
+// deleted since generation gen, evicting least recently used entries to stay
+// within the size bound
+func (t *tieredStorage) add(key string, data []byte, modTime time.Time, gen uint64) {
+	size := int64(len(data))
+	if size > memoryTierMaxEntry || size > t.maxSize {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gen != gen {
+		return
+	}
+	if elem, ok := t.items[key]; ok {
+		t.size -= int64(len(elem.Value.(*memoryEntry).data))
+		t.lru.Remove(elem)
+	}
+	t.items[key] = t.lru.PushFront(&memoryEntry{key: key, data: data, modTime: modTime})
+	t.size += size
+	for t.size > t.maxSize {
+		oldest := t.lru.Back()
+		e := oldest.Value.(*memoryEntry)
+		t.lru.Remove(oldest)
+		delete(t.items, e.key)
+		t.size -= int64(len(e.data))
+	}
+}
+
+// remove drops the memory entry for key and returns the new generation
+func (t *tieredStorage) remove(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.items[key]; ok {
+		t.size -= int64(len(elem.Value.(*memoryEntry).data))
+		t.lru.Remove(elem)
+		delete(t.items, key)
+	}
+	t.gen++
+	return t.gen
+}
+
+// stats returns the counters of the memory tier and of the tier behind it
+func (t *tieredStorage) stats() (memory, backend TierStats) {
+	memory = t.memory.snapshot()
+	t.mu.Lock()
+	memory.Entries, memory.Bytes = len(t.items), t.size
+	t.mu.Unlock()
+	return memory, t.backend.snapshot()
+}
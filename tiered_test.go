@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// hookStorage is a memStorage calling afterGet, if set, once Get has read
+// an entry and before it returns
+type hookStorage struct {
+	*memStorage
+	afterGet func(key string)
+}
+
+func (h *hookStorage) Get(ctx context.Context, key string) (io.ReadCloser, StorageInfo, error) {
+	r, info, err := h.memStorage.Get(ctx, key)
+	if h.afterGet != nil {
+		h.afterGet(key)
+	}
+	return r, info, err
+}
+
+// readAll returns the content of the entry for key in s
+func readAll(t *testing.T, s Storage, key string) (string, error) {
+	t.Helper()
+	r, _, err := s.Get(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+// memoryKeys returns the keys held in the memory tier, most recently used
+// first
+func (t *tieredStorage) memoryKeys() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []string
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*memoryEntry).key)
+	}
+	return keys
+}
+
+func TestTieredStorage(t *testing.T) {
+	testStorage(t, newTieredStorage(newMemStorage(), 1<<20))
+}
+
+func TestTieredStorageLRU(t *testing.T) {
+	ctx := context.Background()
+	next := newMemStorage()
+	tiered := newTieredStorage(next, 30)
+	for _, key := range []string{"a.info", "b.info", "c.info"} {
+		tiered.Put(ctx, key, strings.NewReader(strings.Repeat("x", 10)))
+	}
+	if keys := strings.Join(tiered.memoryKeys(), " "); keys != "c.info b.info a.info" {
+		t.Fatalf("memory tier holds %s", keys)
+	}
+
+	// Reading a makes b the least recently used entry, which d evicts
+	readAll(t, tiered, "a.info")
+	tiered.Put(ctx, "d.info", strings.NewReader(strings.Repeat("x", 10)))
+	if keys := strings.Join(tiered.memoryKeys(), " "); keys != "d.info a.info c.info" {
+		t.Errorf("memory tier holds %s, want d.info a.info c.info", keys)
+	}
+	if memory, _ := tiered.stats(); memory.Bytes != 30 || memory.Entries != 3 {
+		t.Errorf("memory tier holds %d entries of %d bytes, want 3 of 30", memory.Entries, memory.Bytes)
+	}
+
+	// b is still served, from the next tier, and brought back into memory
+	hits := tiered.memory.hits.Load()
+	if data, err := readAll(t, tiered, "b.info"); err != nil || data != strings.Repeat("x", 10) {
+		t.Errorf("Get(b.info) = %q, %v", data, err)
+	}
+	if tiered.memory.hits.Load() != hits || tiered.backend.hits.Load() != 1 {
+		t.Errorf("evicted entry was not read from the next tier")
+	}
+	if keys := tiered.memoryKeys(); keys[0] != "b.info" || len(keys) != 3 {
+		t.Errorf("memory tier holds %v after reading b.info", keys)
+	}
+
+	// Zips and entries larger than the tier bypass it
+	tiered.Put(ctx, "e.zip", strings.NewReader("zip"))
+	tiered.Put(ctx, "f.mod", strings.NewReader(strings.Repeat("x", 31)))
+	readAll(t, tiered, "e.zip")
+	readAll(t, tiered, "f.mod")
+	for _, key := range tiered.memoryKeys() {
+		if key == "e.zip" || key == "f.mod" {
+			t.Errorf("%s held in the memory tier", key)
+		}
+	}
+	if next.data("e.zip") == nil || next.data("f.mod") == nil {
+		t.Errorf("entries bypassing the memory tier were not stored")
+	}
+}
+
+func TestTieredStorageDelete(t *testing.T) {
+	ctx := context.Background()
+	tiered := newTieredStorage(newMemStorage(), 1<<20)
+	tiered.Put(ctx, "a.info", strings.NewReader("old"))
+	readAll(t, tiered, "a.info")
+
+	if err := tiered.Delete(ctx, "a.info"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(t, tiered, "a.info"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get after Delete: err = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := tiered.Stat(ctx, "a.info"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Delete: err = %v, want fs.ErrNotExist", err)
+	}
+
+	// Replacing an entry replaces it in memory
+	tiered.Put(ctx, "a.info", strings.NewReader("new"))
+	tiered.Put(ctx, "a.info", strings.NewReader("newer"))
+	if data, _ := readAll(t, tiered, "a.info"); data != "newer" {
+		t.Errorf("Get after Put = %q, want newer", data)
+	}
+}
+
+func TestTieredStorageStaleRead(t *testing.T) {
+	ctx := context.Background()
+	next := &hookStorage{memStorage: newMemStorage()}
+	next.Put(ctx, "a.info", strings.NewReader("old"))
+	tiered := newTieredStorage(next, 1<<20)
+
+	// The entry is replaced while a read of the old one is in progress
+	next.afterGet = func(key string) {
+		next.afterGet = nil
+		tiered.Put(ctx, key, strings.NewReader("new"))
+	}
+	if data, _ := readAll(t, tiered, "a.info"); data != "old" {
+		t.Fatalf("first Get = %q, want the old entry", data)
+	}
+	// The slow read must not have put the old entry back into memory
+	if data, _ := readAll(t, tiered, "a.info"); data != "new" {
+		t.Errorf("Get after the replacement = %q, want new", data)
+	}
+
+	// Likewise for a delete
+	next.afterGet = func(key string) {
+		next.afterGet = nil
+		tiered.Delete(ctx, key)
+	}
+	tiered.remove("a.info") // make the next read miss memory
+	readAll(t, tiered, "a.info")
+	if _, err := readAll(t, tiered, "a.info"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get after the delete: err = %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// upstreamEntry is one element of a GOPROXY-style upstream list
+type upstreamEntry struct {
+	url string
+	// fallThrough is set when the entry is followed by "|": the next entry
+	// is tried after any error, not only after 404/410 as with ","
+	fallThrough bool
+}
+
+// parseUpstreams parses a comma/pipe-separated upstream list with GOPROXY
+// semantics, e.g. "https://proxy.golang.org,https://goproxy.cn|https://goproxy.io".
+// The keyword "direct" fetches modules from version control, see vcsFetcher.
+func parseUpstreams(list string) ([]upstreamEntry, error) {
+	var entries []upstreamEntry
+	for list != "" {
+		var entry upstreamEntry
+		i := strings.IndexAny(list, ",|")
+		if i >= 0 {
+			entry.url, entry.fallThrough = list[:i], list[i] == '|'
+			list = list[i+1:]
+		} else {
+			entry.url, list = list, ""
+		}
+
+		entry.url = strings.TrimSuffix(strings.TrimSpace(entry.url), "/")
+		if entry.url == "" {
+			continue
+		}
+		if entry.url == directUpstream {
+			entries = append(entries, entry)
+			continue
+		}
+		u, err := url.Parse(entry.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q: must be an http or https URL or \"direct\"", entry.url)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no upstream configured")
+	}
+	return entries, nil
+}
+
+// upstreamGroup is an upstream list together with the HTTP client (and so
+// the proxy and DNS settings) used to reach it
+type upstreamGroup struct {
+	upstreams []upstreamEntry
+	client    *http.Client
+	direct    *vcsFetcher // nil unless the list contains "direct"
+}
+
+// newUpstreamGroup parses list (see parseUpstreams) and builds a client that
+// connects through httpProxy and resolves with dnsServer
+func (p *Proxy) newUpstreamGroup(list, httpProxy, dnsServer string) (*upstreamGroup, error) {
+	upstreams, err := parseUpstreams(list)
+	if err != nil {
+		return nil, err
+	}
+	g := &upstreamGroup{upstreams: upstreams, client: newHTTPClient(httpProxy, dnsServer, p.dnsCache)}
+	for _, u := range upstreams {
+		if u.url == directUpstream {
+			g.direct = &vcsFetcher{
+				cacheDir:  p.cacheDir,
+				httpProxy: httpProxy,
+				client:    g.client,
+				fetchTTL:  p.listTTL,
+				locks:     &p.locks,
+			}
+			break
+		}
+	}
+	return g, nil
+}
+
+// openURL issues a GET for url with the group's HTTP client. Any status but
+// 200 (and 304, for conditional requests) is returned as an upstreamError.
+// The caller must close the body.
+func (g *upstreamGroup) openURL(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return nil, &upstreamError{url: url, status: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// open issues a GET for path against the upstreams in order and returns the
+// first successful response. Like the go command with GOPROXY, it moves on to
+// the next upstream after a 404/410, or after any error if the upstream was
+// followed by "|". header is added to each request; when it carries
+// conditional headers a 304 response is returned as well. The caller must
+// close the body.
+func (g *upstreamGroup) open(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	var err error
+	for i, u := range g.upstreams {
+		var resp *http.Response
+		start := time.Now()
+		if u.url == directUpstream {
+			resp, err = g.direct.open(ctx, path)
+		} else {
+			resp, err = g.openURL(ctx, fmt.Sprintf("%s/%s", u.url, path), header)
+		}
+		upstreamDuration.WithLabelValues(u.url, outcome(err)).Observe(time.Since(start).Seconds())
+		if err == nil {
+			accessFrom(ctx).upstream = u.url
+			logger(ctx).Debug("Fetched from upstream", "path", path, "upstream", u.url)
+			return resp, nil
+		}
+		if ctx.Err() != nil || i == len(g.upstreams)-1 || !(u.fallThrough || isNotFound(err)) {
+			break
+		}
+		logger(ctx).Info("Upstream failed; trying next upstream", "path", path, "upstream", u.url, "err", err)
+	}
+	return nil, err
+}
+
+// Route sends modules whose path matches Patterns to their own upstreams,
+// e.g. private modules to an internal Athens instance
+type Route struct {
+	Patterns  string // comma-separated module path globs, as in GOPRIVATE
+	Upstream  string // GOPROXY-style list, see parseUpstreams
+	HTTPProxy string // proxy for this route's upstreams; empty means none
+	DNSServer string // DNS server for this route; empty means the system resolver
+}
+
+// parseRoute parses a route spec of the form
+// "patterns=upstreams[;proxy=URL][;dns=SERVER]", e.g.
+// "git.corp.example.com/*,corp.example.org=https://athens.internal;dns=10.0.0.2:53"
+func parseRoute(spec string) (Route, error) {
+	fields := strings.Split(spec, ";")
+	patterns, upstreams, ok := strings.Cut(fields[0], "=")
+	if !ok || strings.TrimSpace(patterns) == "" || strings.TrimSpace(upstreams) == "" {
+		return Route{}, fmt.Errorf("invalid route %q: want patterns=upstreams[;proxy=URL][;dns=SERVER]", spec)
+	}
+	r := Route{Patterns: strings.TrimSpace(patterns), Upstream: strings.TrimSpace(upstreams)}
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch strings.TrimSpace(name) {
+		case "proxy":
+			r.HTTPProxy = strings.TrimSpace(value)
+		case "dns":
+			r.DNSServer = strings.TrimSpace(value)
+		case "":
+		default:
+			return Route{}, fmt.Errorf("invalid route %q: unknown option %q", spec, name)
+		}
+	}
+	return r, nil
+}
+
+// route is a configured Route with its upstream group
+type route struct {
+	patterns string
+	group    *upstreamGroup
+}
+
+// upstreamFor returns the upstream group for modPath: the first route whose
+// patterns match it, or the default upstreams
+func (p *Proxy) upstreamFor(modPath string) *upstreamGroup {
+	for _, r := range p.routes {
+		if module.MatchPrefixPatterns(r.patterns, modPath) {
+			return r.group
+		}
+	}
+	return p.upstream
+}
+
+// openUpstream opens path on the upstreams that serve modPath, see
+// upstreamGroup.open. In offline mode it fails with errOffline.
+func (p *Proxy) openUpstream(ctx context.Context, modPath, path string, header http.Header) (*http.Response, error) {
+	if p.offline {
+		return nil, errOffline
+	}
+	return p.upstreamFor(modPath).open(ctx, path, header)
+}
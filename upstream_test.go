@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	for _, tt := range []struct {
+		list string
+		want string // url and separator of each entry; empty if invalid
+	}{
+		{"https://proxy.golang.org", "https://proxy.golang.org,"},
+		{" https://a.example/ , https://b.example|direct ", "https://a.example, https://b.example| direct,"},
+		{"https://a.example,,https://b.example", "https://a.example, https://b.example,"},
+		{"direct", "direct,"},
+		{"", ""},
+		{",|", ""},
+		{"ftp://a.example", ""},
+		{"https://", ""},
+		{"off", ""},
+	} {
+		entries, err := parseUpstreams(tt.list)
+		var got []string
+		for _, e := range entries {
+			sep := ","
+			if e.fallThrough {
+				sep = "|"
+			}
+			got = append(got, e.url+sep)
+		}
+		if strings.Join(got, " ") != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("parseUpstreams(%q) = %v, %v, want %s", tt.list, got, err, tt.want)
+		}
+	}
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	// Upstreams answering every request with a fixed status, and one whose
+	// connections are refused
+	urls := make(map[string]string)
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	for name, status := range map[string]int{"ok": http.StatusOK, "404": http.StatusNotFound, "410": http.StatusGone, "500": http.StatusInternalServerError} {
+		name, status := name, status
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			w.WriteHeader(status)
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		urls[name] = s.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	urls["down"] = down.URL
+
+	for _, tt := range []struct {
+		list   string
+		status int    // of the result: 200 or that of the error
+		served string // the upstream that answered with 200
+		hit    string // upstreams that were asked, in any order
+	}{
+		{"{ok},{404}", http.StatusOK, "ok", "ok"},
+		{"{404},{ok}", http.StatusOK, "ok", "404 ok"},
+		{"{410},{ok}", http.StatusOK, "ok", "410 ok"},
+		{"{500},{ok}", http.StatusInternalServerError, "", "500"},
+		{"{down},{ok}", http.StatusBadGateway, "", ""},
+		{"{404}|{ok}", http.StatusOK, "ok", "404 ok"},
+		{"{500}|{ok}", http.StatusOK, "ok", "500 ok"},
+		{"{down}|{ok}", http.StatusOK, "ok", "ok"},
+		{"{500}|{404},{ok}", http.StatusOK, "ok", "404 500 ok"},
+		{"{404},{500}|{ok}", http.StatusOK, "ok", "404 500 ok"},
+		// The error of the last upstream tried is returned
+		{"{500}|{404}", http.StatusNotFound, "", "404 500"},
+		{"{404},{500}", http.StatusInternalServerError, "", "404 500"},
+		{"{404},{410}", http.StatusGone, "", "404 410"},
+		{"{500}|{down}", http.StatusBadGateway, "", "500"},
+	} {
+		list := tt.list
+		for name, url := range urls {
+			list = strings.ReplaceAll(list, "{"+name+"}", url)
+		}
+		upstreams, err := parseUpstreams(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := &upstreamGroup{upstreams: upstreams, client: http.DefaultClient}
+		mu.Lock()
+		clear(hits)
+		mu.Unlock()
+
+		rec := &accessRecord{}
+		resp, err := g.open(withAccess(context.Background(), rec), "example.com/m/@v/list", nil)
+		status := http.StatusOK
+		if err != nil {
+			status = errorStatus(err)
+		} else {
+			resp.Body.Close()
+		}
+		if status != tt.status {
+			t.Errorf("%s: status %d (err %v), want %d", tt.list, status, err, tt.status)
+		}
+		if want := urls[tt.served]; rec.upstream != want {
+			t.Errorf("%s: access record names upstream %q, want %q", tt.list, rec.upstream, want)
+		}
+		mu.Lock()
+		var hit []string
+		for name := range hits {
+			hit = append(hit, name)
+		}
+		mu.Unlock()
+		sort.Strings(hit)
+		if strings.Join(hit, " ") != tt.hit {
+			t.Errorf("%s: asked %v, want %s", tt.list, hit, tt.hit)
+		}
+	}
+}
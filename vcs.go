@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// directUpstream is the upstream list keyword that makes the proxy fetch
+// modules from version control itself, like GOPROXY=direct
+const directUpstream = "direct"
+
+// vcsProtocols are the git transports remotes may use (GIT_ALLOW_PROTOCOL).
+// Others, like file and ext, would let a go-import page make the proxy
+// read local repositories, including its own mirrors.
+const vcsProtocols = "https:ssh"
+
+// goImportPattern matches the <meta name="go-import"> tags of a go-get=1 page
+var goImportPattern = regexp.MustCompile(`<meta\s+name="go-import"\s+content="([^"]*)"`)
+
+// vcsFetcher synthesizes module proxy responses from git repositories. Each
+// repository is mirrored under <cache>/.vcs and fetched again when a list,
+// @latest or version query needs fresh data, at most once per fetchTTL.
+type vcsFetcher struct {
+	cacheDir  string
+	httpProxy string       // passed to git as http.proxy
+	client    *http.Client // used for go-get=1 lookups
+	fetchTTL  time.Duration
+	protocols string      // GIT_ALLOW_PROTOCOL for git; vcsProtocols if empty
+	locks     *keyedMutex // the proxy's cache locks, keyed by mirror
+	roots     sync.Map    // module path -> repository root (vcsRoot)
+	fetched   sync.Map    // repository root -> time of the last git fetch
+}
+
+// vcsRoot is a repository root module path and its git remote
+type vcsRoot struct {
+	root string // e.g. github.com/user/repo
+	url  string // e.g. https://github.com/user/repo
+}
+
+// vcsRepo is a module inside a mirrored git repository
+type vcsRepo struct {
+	vcsRoot
+	modPath   string
+	dir       string // local mirror, holding a bare repository in dir/.git
+	key       string // cache key of the mirror, used for locking
+	codeDir   string // module directory inside the repository, "" for the root
+	pathMajor string // major version suffix of modPath, e.g. "v2"
+}
+
+// tagPrefix returns the prefix of the module's version tags
+func (r *vcsRepo) tagPrefix() string {
+	if r.codeDir == "" {
+		return ""
+	}
+	return r.codeDir + "/"
+}
+
+// vcsNotFound logs why a module or version could not be resolved and returns
+// a 404 upstreamError, so that callers fall back and clients see 404
+func vcsNotFound(modPath, query string, err error) error {
+	slog.Info("Not found in version control", "module", modPath, "query", query, "err", err)
+	return &upstreamError{url: fmt.Sprintf("%s:%s@%s", directUpstream, modPath, query), status: http.StatusNotFound}
+}
+
+// open answers the module proxy request path from version control. The
+// response looks like one from an upstream proxy; zips are built into a temp
+// file that is removed when the body is closed.
+func (f *vcsFetcher) open(ctx context.Context, path string) (*http.Response, error) {
+	mreq, err := parseRequest(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, zipFetchTimeout)
+	defer cancel()
+
+	repo, err := f.repo(ctx, mreq.Module)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mreq.Kind {
+	case kindList:
+		if err := f.update(ctx, repo); err != nil {
+			return nil, err
+		}
+		versions, err := f.versions(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, v := range versions {
+			fmt.Fprintln(&buf, v)
+		}
+		return dataResponse(buf.Bytes()), nil
+
+	case kindLatest, kindInfo:
+		query := mreq.Version
+		if mreq.Kind == kindLatest {
+			query = "latest"
+		}
+		version, commit, err := f.stat(ctx, repo, query)
+		if err != nil {
+			return nil, err
+		}
+		t, err := f.commitTime(ctx, repo, commit)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(struct {
+			Version string
+			Time    time.Time
+		}{version, t})
+		if err != nil {
+			return nil, err
+		}
+		return dataResponse(data), nil
+
+	case kindMod:
+		_, commit, err := f.stat(ctx, repo, mreq.Version)
+		if err != nil {
+			return nil, err
+		}
+		data, err := f.goMod(ctx, repo, commit)
+		if err != nil {
+			return nil, err
+		}
+		return dataResponse(data), nil
+
+	case kindZip:
+		_, commit, err := f.stat(ctx, repo, mreq.Version)
+		if err != nil {
+			return nil, err
+		}
+		return f.zip(ctx, repo, mreq.Version, commit)
+	}
+	return nil, errUnknownEndpoint
+}
+
+// dataResponse wraps data in a 200 response
+func dataResponse(data []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		ContentLength: int64(len(data)),
+		Body:          io.NopCloser(bytes.NewReader(data)),
+	}
+}
+
+// tempFileBody is a response body reading a temp file, which is removed on Close
+type tempFileBody struct {
+	*os.File
+}
+
+func (b tempFileBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// repo resolves the repository holding modPath and makes sure it is mirrored
+func (f *vcsFetcher) repo(ctx context.Context, modPath string) (*vcsRepo, error) {
+	root, err := f.repoRoot(ctx, modPath)
+	if err != nil {
+		return nil, err
+	}
+
+	escRoot, err := module.EscapePath(root.root)
+	if err != nil {
+		return nil, err
+	}
+	key := ".vcs/" + escRoot
+	dir, err := cachePath(f.cacheDir, key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, pathMajor, _ := module.SplitPathVersion(modPath)
+	repo := &vcsRepo{
+		vcsRoot:   root,
+		modPath:   modPath,
+		dir:       dir,
+		key:       key,
+		codeDir:   strings.TrimPrefix(strings.TrimPrefix(prefix, root.root), "/"),
+		pathMajor: strings.TrimLeft(pathMajor, "/."),
+	}
+
+	// Mirrors are renamed into place once complete, so a present .git is usable
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return repo, nil
+	}
+	unlock := f.locks.Lock(key)
+	defer unlock()
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return repo, nil
+	}
+	if err := f.clone(ctx, repo); err != nil {
+		return nil, vcsNotFound(modPath, "", err)
+	}
+	return repo, nil
+}
+
+// repoRoot finds the repository root and git remote of modPath, from the
+// well-known hosting sites or from the go-get=1 <meta name="go-import"> tag
+// served at the module path, as the go command does
+func (f *vcsFetcher) repoRoot(ctx context.Context, modPath string) (vcsRoot, error) {
+	if root, ok := f.roots.Load(modPath); ok {
+		return root.(vcsRoot), nil
+	}
+
+	elems := strings.Split(modPath, "/")
+	switch elems[0] {
+	case "github.com", "gitlab.com", "bitbucket.org":
+		if len(elems) < 3 {
+			return vcsRoot{}, vcsNotFound(modPath, "", fmt.Errorf("invalid %s import path", elems[0]))
+		}
+		root := strings.Join(elems[:3], "/")
+		r := vcsRoot{root: root, url: "https://" + root}
+		f.roots.Store(modPath, r)
+		return r, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+modPath+"?go-get=1", nil)
+	if err != nil {
+		return vcsRoot{}, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return vcsRoot{}, err
+	}
+	defer resp.Body.Close()
+	page, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return vcsRoot{}, err
+	}
+
+	for _, m := range goImportPattern.FindAllSubmatch(page, -1) {
+		fields := strings.Fields(string(m[1]))
+		if len(fields) != 3 {
+			continue
+		}
+		prefix, vcs, remote := fields[0], fields[1], fields[2]
+		if modPath != prefix && !strings.HasPrefix(modPath, prefix+"/") {
+			continue
+		}
+		if vcs != "git" {
+			return vcsRoot{}, vcsNotFound(modPath, "", fmt.Errorf("unsupported version control system %q", vcs))
+		}
+		if err := checkRemote(remote); err != nil {
+			return vcsRoot{}, vcsNotFound(modPath, "", err)
+		}
+		r := vcsRoot{root: prefix, url: remote}
+		f.roots.Store(modPath, r)
+		return r, nil
+	}
+	return vcsRoot{}, vcsNotFound(modPath, "", fmt.Errorf("no go-import meta tag at https://%s?go-get=1", modPath))
+}
+
+// checkRemote rejects git remotes other than https:// and ssh:// URLs
+func checkRemote(remote string) error {
+	u, err := url.Parse(remote)
+	if err != nil || strings.HasPrefix(remote, "-") || u.Host == "" || (u.Scheme != "https" && u.Scheme != "ssh") {
+		return fmt.Errorf("unsupported git remote %q (only https:// and ssh:// URLs are allowed)", remote)
+	}
+	return nil
+}
+
+// git runs a git command in dir and returns its output
+func (f *vcsFetcher) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var gitArgs []string
+	if f.httpProxy != "" {
+		gitArgs = append(gitArgs, "-c", "http.proxy="+f.httpProxy)
+	}
+	cmd := exec.CommandContext(ctx, "git", append(gitArgs, args...)...)
+	cmd.Dir = dir
+	protocols := f.protocols
+	if protocols == "" {
+		protocols = vcsProtocols
+	}
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+protocols, "PWD="+dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// clone creates the mirror of repo. Only branches and tags are fetched. The
+// bare repository lives in a .git directory so that modzip.CreateFromVCS
+// accepts it. The caller must hold the mirror's write lock.
+func (f *vcsFetcher) clone(ctx context.Context, repo *vcsRepo) error {
+	logger(ctx).Info("Cloning repository", "url", repo.url, "root", repo.root)
+	if err := os.MkdirAll(filepath.Dir(repo.dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(repo.dir), filepath.Base(repo.dir)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp) // no-op once renamed
+
+	steps := [][]string{
+		{"init", "--bare", "--quiet", ".git"},
+		{"-C", ".git", "remote", "add", "origin", "--", repo.url},
+		{"-C", ".git", "config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*"},
+		{"-C", ".git", "config", "--add", "remote.origin.fetch", "+refs/tags/*:refs/tags/*"},
+		{"-C", ".git", "fetch", "--quiet", "origin"},
+	}
+	for _, args := range steps {
+		if _, err := f.git(ctx, tmp, args...); err != nil {
+			return err
+		}
+	}
+
+	// Point HEAD at the remote default branch, used for @latest without tags
+	if out, err := f.git(ctx, tmp, "ls-remote", "--symref", "--", repo.url, "HEAD"); err == nil {
+		if ref, ok := strings.CutPrefix(string(out), "ref: "); ok {
+			ref, _, _ = strings.Cut(ref, "\t")
+			f.git(ctx, tmp, "symbolic-ref", "HEAD", ref)
+		}
+	}
+
+	if err := os.Rename(tmp, repo.dir); err != nil {
+		return err
+	}
+	f.fetched.Store(repo.root, time.Now())
+	return nil
+}
+
+// update fetches new branches and tags into the mirror of repo, unless that
+// happened less than fetchTTL ago
+func (f *vcsFetcher) update(ctx context.Context, repo *vcsRepo) error {
+	unlock := f.locks.Lock(repo.key)
+	defer unlock()
+	if last, ok := f.fetched.Load(repo.root); ok && time.Since(last.(time.Time)) < f.fetchTTL {
+		return nil
+	}
+	if _, err := f.git(ctx, repo.dir, "fetch", "--quiet", "--prune", "origin"); err != nil {
+		return err
+	}
+	f.fetched.Store(repo.root, time.Now())
+	return nil
+}
+
+// read runs a git command that only reads the mirror of repo
+func (f *vcsFetcher) read(ctx context.Context, repo *vcsRepo, args ...string) ([]byte, error) {
+	unlock := f.locks.RLock(repo.key)
+	defer unlock()
+	return f.git(ctx, repo.dir, args...)
+}
+
+// versions returns the release and pre-release versions of the module,
+// taken from its tags, in semver order
+func (f *vcsFetcher) versions(ctx context.Context, repo *vcsRepo) ([]string, error) {
+	out, err := f.read(ctx, repo, "for-each-ref", "--format=%(refname:lstrip=2)", strings.TrimSuffix("refs/tags/"+repo.tagPrefix(), "/"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, tag := range strings.Fields(string(out)) {
+		v := strings.TrimPrefix(tag, repo.tagPrefix())
+		if v != module.CanonicalVersion(v) || module.IsPseudoVersion(v) || module.Check(repo.modPath, v) != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+// revParse resolves rev to a commit hash in the mirror of repo
+func (f *vcsFetcher) revParse(ctx context.Context, repo *vcsRepo, rev string) (string, error) {
+	out, err := f.read(ctx, repo, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// stat resolves query (a version, "latest", a branch, tag or commit) to the
+// module version and commit it names, fetching the repository if needed
+func (f *vcsFetcher) stat(ctx context.Context, repo *vcsRepo, query string) (version, commit string, err error) {
+	if strings.HasPrefix(query, "-") {
+		return "", "", vcsNotFound(repo.modPath, query, fmt.Errorf("invalid query"))
+	}
+
+	// resolve looks rev up, fetching once if the mirror does not have it yet
+	resolve := func(rev string) (string, error) {
+		if commit, err := f.revParse(ctx, repo, rev); err == nil {
+			return commit, nil
+		}
+		if err := f.update(ctx, repo); err != nil {
+			return "", err
+		}
+		commit, err := f.revParse(ctx, repo, rev)
+		if err != nil {
+			return "", vcsNotFound(repo.modPath, query, fmt.Errorf("unknown revision %s", rev))
+		}
+		return commit, nil
+	}
+
+	switch {
+	case module.IsPseudoVersion(query):
+		rev, err := module.PseudoVersionRev(query)
+		if err != nil {
+			return "", "", vcsNotFound(repo.modPath, query, err)
+		}
+		commit, err := resolve(rev)
+		if err != nil {
+			return "", "", err
+		}
+		if commit[:12] != rev {
+			return "", "", vcsNotFound(repo.modPath, query, fmt.Errorf("revision %s does not match commit %s", rev, commit[:12]))
+		}
+		if err := f.checkPseudoVersion(ctx, repo, query, commit); err != nil {
+			return "", "", err
+		}
+		return query, commit, nil
+
+	case query == module.CanonicalVersion(query) && semver.IsValid(query):
+		if err := module.Check(repo.modPath, query); err != nil {
+			return "", "", vcsNotFound(repo.modPath, query, err)
+		}
+		commit, err := resolve("refs/tags/" + repo.tagPrefix() + query)
+		return query, commit, err
+
+	case query == "latest":
+		if err := f.update(ctx, repo); err != nil {
+			return "", "", err
+		}
+		versions, err := f.versions(ctx, repo)
+		if err != nil {
+			return "", "", err
+		}
+		var best string
+		for _, v := range versions {
+			if best == "" || newerVersion(v, best) {
+				best = v
+			}
+		}
+		if best != "" {
+			commit, err := resolve("refs/tags/" + repo.tagPrefix() + best)
+			return best, commit, err
+		}
+		query = "HEAD"
+	}
+
+	// A branch, tag or commit: use a version tag on the commit if there is
+	// one, a pseudo-version otherwise
+	if err := f.update(ctx, repo); err != nil {
+		return "", "", err
+	}
+	commit, err = resolve(query)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := f.read(ctx, repo, "tag", "--points-at", commit)
+	if err != nil {
+		return "", "", err
+	}
+	for _, tag := range strings.Fields(string(out)) {
+		v, ok := strings.CutPrefix(tag, repo.tagPrefix())
+		if ok && v == module.CanonicalVersion(v) && !module.IsPseudoVersion(v) && module.Check(repo.modPath, v) == nil {
+			if version == "" || semver.Compare(v, version) > 0 {
+				version = v
+			}
+		}
+	}
+	if version != "" {
+		return version, commit, nil
+	}
+	version, err = f.pseudoVersion(ctx, repo, commit)
+	return version, commit, err
+}
+
+// checkPseudoVersion checks that the pseudo-version version could have been
+// built for commit, like the go command does: its timestamp must be the
+// commit time, and its base version must be tagged on an ancestor of commit.
+// Otherwise made-up pseudo-versions would be cached as if they existed.
+func (f *vcsFetcher) checkPseudoVersion(ctx context.Context, repo *vcsRepo, version, commit string) error {
+	if err := module.Check(repo.modPath, version); err != nil {
+		return vcsNotFound(repo.modPath, version, err)
+	}
+	t, err := module.PseudoVersionTime(version)
+	if err != nil {
+		return vcsNotFound(repo.modPath, version, err)
+	}
+	commitTime, err := f.commitTime(ctx, repo, commit)
+	if err != nil {
+		return err
+	}
+	if !t.Equal(commitTime) {
+		return vcsNotFound(repo.modPath, version, fmt.Errorf("timestamp does not match commit time %s", commitTime.Format(time.RFC3339)))
+	}
+
+	base, err := module.PseudoVersionBase(version)
+	if err != nil {
+		return vcsNotFound(repo.modPath, version, err)
+	}
+	if base == "" {
+		return nil
+	}
+	tag := "refs/tags/" + repo.tagPrefix() + base
+	if _, err := f.revParse(ctx, repo, tag); err != nil {
+		return vcsNotFound(repo.modPath, version, fmt.Errorf("base version %s is not tagged", base))
+	}
+	_, err = f.read(ctx, repo, "merge-base", "--is-ancestor", tag, commit)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return vcsNotFound(repo.modPath, version, fmt.Errorf("base version %s is not an ancestor of %s", base, commit[:12]))
+	}
+	return err
+}
+
+// pseudoVersion builds the pseudo-version of commit, based on the highest
+// version of the module tagged on it or an ancestor, like the go command.
+// Tags of other major versions, even if more recent, are not considered.
+func (f *vcsFetcher) pseudoVersion(ctx context.Context, repo *vcsRepo, commit string) (string, error) {
+	t, err := f.commitTime(ctx, repo, commit)
+	if err != nil {
+		return "", err
+	}
+	out, err := f.read(ctx, repo, "tag", "--merged", commit, "--list", repo.tagPrefix()+"v*")
+	if err != nil {
+		return "", err
+	}
+	var older string
+	for _, tag := range strings.Fields(string(out)) {
+		v := strings.TrimPrefix(tag, repo.tagPrefix())
+		if v != module.CanonicalVersion(v) || module.IsPseudoVersion(v) || module.Check(repo.modPath, v) != nil {
+			continue
+		}
+		if older == "" || semver.Compare(v, older) > 0 {
+			older = v
+		}
+	}
+	return module.PseudoVersion(repo.pathMajor, older, t, commit[:12]), nil
+}
+
+// commitTime returns the commit time of commit in UTC
+func (f *vcsFetcher) commitTime(ctx context.Context, repo *vcsRepo, commit string) (time.Time, error) {
+	out, err := f.read(ctx, repo, "log", "-1", "--format=%ct", commit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// hasFile reports whether the tree of commit contains file. Unlike a
+// failing git cat-file, an error means the mirror could not be read.
+func (f *vcsFetcher) hasFile(ctx context.Context, repo *vcsRepo, commit, file string) (bool, error) {
+	out, err := f.read(ctx, repo, "ls-tree", "--name-only", commit, "--", file)
+	if err != nil {
+		return false, err
+	}
+	return len(bytes.TrimSpace(out)) > 0, nil
+}
+
+// moduleDir returns the directory of the module at commit: codeDir, or its
+// major version subdirectory (e.g. "v2") if that has a go.mod
+func (f *vcsFetcher) moduleDir(ctx context.Context, repo *vcsRepo, commit string) (string, error) {
+	if repo.pathMajor != "" {
+		dir := path.Join(repo.codeDir, repo.pathMajor)
+		ok, err := f.hasFile(ctx, repo, commit, path.Join(dir, "go.mod"))
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return dir, nil
+		}
+	}
+	return repo.codeDir, nil
+}
+
+// goMod returns the go.mod of the module at commit. Like the go command, it
+// synthesizes one if the module has no go.mod.
+func (f *vcsFetcher) goMod(ctx context.Context, repo *vcsRepo, commit string) ([]byte, error) {
+	dir, err := f.moduleDir(ctx, repo, commit)
+	if err != nil {
+		return nil, err
+	}
+	file := path.Join(dir, "go.mod")
+	ok, err := f.hasFile(ctx, repo, commit, file)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []byte(fmt.Sprintf("module %s\n", repo.modPath)), nil
+	}
+	return f.read(ctx, repo, "cat-file", "blob", commit+":"+file)
+}
+
+// zip builds the module zip of version at commit into a temp file
+func (f *vcsFetcher) zip(ctx context.Context, repo *vcsRepo, version, commit string) (*http.Response, error) {
+	dir, err := f.moduleDir(ctx, repo, commit)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(repo.dir), filepath.Base(repo.dir)+".*.zip.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := f.locks.RLock(repo.key)
+	m := module.Version{Path: repo.modPath, Version: version}
+	err = modzip.CreateFromVCS(tmp, m, repo.dir, commit, dir)
+	unlock()
+	var size int64
+	if err == nil {
+		size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tempFileBody{tmp}.Close()
+		return nil, err
+	}
+
+	logger(ctx).Info("Built zip from version control", "module", repo.modPath, "version", version, "commit", commit[:12])
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		ContentLength: size,
+		Body:          tempFileBody{tmp},
+	}, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// testRepo is a git repository holding the module example.com/m and the
+// modules example.com/m/sub, example.com/m/legacy (without go.mod) and
+// example.com/m/v2 (in the v2 subdirectory)
+type testRepo struct {
+	dir     string
+	commits []string    // in order
+	times   []time.Time // commit times
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	r := &testRepo{dir: t.TempDir()}
+	r.git(t, time.Time{}, "init", "--quiet", "--initial-branch=main")
+
+	r.commit(t, map[string]string{
+		"go.mod":        "module example.com/m\n\ngo 1.21\n",
+		"m.go":          "package m\n",
+		"sub/go.mod":    "module example.com/m/sub\n",
+		"sub/sub.go":    "package sub\n",
+		"legacy/old.go": "package legacy\n",
+	}, "v1.0.0", "sub/v1.0.0", "legacy/v1.0.0")
+	r.commit(t, map[string]string{"m.go": "package m\n\nconst V = 1\n"}, "v1.1.0")
+	r.commit(t, map[string]string{
+		"v2/go.mod": "module example.com/m/v2\n",
+		"v2/m.go":   "package m\n\nconst V = 2\n",
+	}, "v2.0.0")
+	r.commit(t, map[string]string{"m.go": "package m\n\nconst V = 3\n"})
+	return r
+}
+
+// git runs a git command in the repository, committing at time at
+func (r *testRepo) git(t *testing.T, at time.Time, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = r.dir
+	date := at.Format(time.RFC3339)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", args[0], err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files, commits them an hour after the previous commit and
+// tags the commit with tags
+func (r *testRepo) commit(t *testing.T, files map[string]string, tags ...string) {
+	t.Helper()
+	for name, data := range files {
+		file := filepath.Join(r.dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := time.Date(2024, 1, 1, len(r.commits), 0, 0, 0, time.UTC)
+	r.git(t, at, "add", "-A")
+	r.git(t, at, "commit", "--quiet", "-m", fmt.Sprintf("commit %d", len(r.commits)))
+	for _, tag := range tags {
+		r.git(t, at, "tag", tag)
+	}
+	r.commits = append(r.commits, r.git(t, at, "rev-parse", "HEAD"))
+	r.times = append(r.times, at)
+}
+
+// newDirectProxy returns a proxy fetching the modules of repo from version
+// control
+func newDirectProxy(t *testing.T, repo *testRepo) *Proxy {
+	t.Helper()
+	p := newTestProxyConfig(t, Config{Upstream: directUpstream, Storage: newMemStorage()})
+	f := p.upstream.direct
+	f.protocols = "file"
+	for _, modPath := range []string{"example.com/m", "example.com/m/sub", "example.com/m/legacy", "example.com/m/v2"} {
+		f.roots.Store(modPath, vcsRoot{root: "example.com/m", url: "file://" + repo.dir})
+	}
+	return p
+}
+
+// zipFiles returns the names of the files in a module zip
+func zipFiles(t *testing.T, data []byte) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDirect(t *testing.T) {
+	repo := newTestRepo(t)
+	p := newDirectProxy(t, repo)
+
+	for _, tt := range []struct {
+		path string
+		body string // for everything but zips
+	}{
+		{"example.com/m/@v/list", "v1.0.0\nv1.1.0\n"},
+		{"example.com/m/@latest", `{"Version":"v1.1.0","Time":"2024-01-01T01:00:00Z"}`},
+		{"example.com/m/@v/v1.0.0.info", `{"Version":"v1.0.0","Time":"2024-01-01T00:00:00Z"}`},
+		{"example.com/m/@v/v1.0.0.mod", "module example.com/m\n\ngo 1.21\n"},
+		{"example.com/m/sub/@v/list", "v1.0.0\n"},
+		{"example.com/m/sub/@v/v1.0.0.mod", "module example.com/m/sub\n"},
+		{"example.com/m/legacy/@v/v1.0.0.mod", "module example.com/m/legacy\n"},
+		{"example.com/m/v2/@v/list", "v2.0.0\n"},
+		{"example.com/m/v2/@latest", `{"Version":"v2.0.0","Time":"2024-01-01T02:00:00Z"}`},
+		{"example.com/m/v2/@v/v2.0.0.mod", "module example.com/m/v2\n"},
+	} {
+		w := get(p, "/"+tt.path)
+		if w.Code != http.StatusOK || w.Body.String() != tt.body {
+			t.Errorf("GET %s = %d %q, want 200 %q", tt.path, w.Code, w.Body, tt.body)
+		}
+	}
+
+	for _, tt := range []struct {
+		path  string
+		files []string
+	}{
+		// Nested modules are not part of the module zip
+		{"example.com/m/@v/v1.0.0.zip", []string{"example.com/m@v1.0.0/go.mod", "example.com/m@v1.0.0/legacy/old.go", "example.com/m@v1.0.0/m.go"}},
+		{"example.com/m/sub/@v/v1.0.0.zip", []string{"example.com/m/sub@v1.0.0/go.mod", "example.com/m/sub@v1.0.0/sub.go"}},
+		{"example.com/m/v2/@v/v2.0.0.zip", []string{"example.com/m/v2@v2.0.0/go.mod", "example.com/m/v2@v2.0.0/m.go"}},
+	} {
+		w := get(p, "/"+tt.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s = %d %q", tt.path, w.Code, w.Body)
+			continue
+		}
+		if files := zipFiles(t, w.Body.Bytes()); strings.Join(files, " ") != strings.Join(tt.files, " ") {
+			t.Errorf("GET %s: zip holds %v, want %v", tt.path, files, tt.files)
+		}
+	}
+
+	// Unknown modules and versions
+	for _, path := range []string{
+		"example.com/m/@v/v1.2.0.info",
+		"example.com/m/@v/v1.2.0.mod",
+		"example.com/m/sub/@v/v1.1.0.zip",
+		"example.com/m/@v/nosuchbranch.info",
+	} {
+		if w := get(p, "/"+path); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestDirectPseudoVersion(t *testing.T) {
+	repo := newTestRepo(t)
+	p := newDirectProxy(t, repo)
+
+	// The untagged head of main gets a pseudo-version based on v1.1.0
+	head, headTime := repo.commits[3], repo.times[3]
+	want := module.PseudoVersion("", "v1.1.0", headTime, head[:12])
+	w := get(p, "/example.com/m/@v/main.info")
+	var info struct{ Version string }
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &info) != nil || info.Version != want {
+		t.Fatalf("GET main.info = %d %q, want version %s", w.Code, w.Body, want)
+	}
+	if w := get(p, "/example.com/m/@v/"+want+".mod"); w.Code != http.StatusOK || w.Body.String() != "module example.com/m\n\ngo 1.21\n" {
+		t.Errorf("GET %s.mod = %d %q", want, w.Code, w.Body)
+	}
+
+	// Pseudo-versions that the go command would not have built for a commit
+	for _, v := range []string{
+		module.PseudoVersion("", "v1.1.0", headTime.Add(time.Hour), head[:12]),       // wrong time
+		module.PseudoVersion("", "v1.5.0", headTime, head[:12]),                      // untagged base
+		module.PseudoVersion("", "v1.1.0", repo.times[0], repo.commits[0][:12]),      // base not an ancestor
+		module.PseudoVersion("", "v1.1.0", headTime, strings.Repeat("0", 12)),        // unknown commit
+		module.PseudoVersion("", "", headTime, head[:12])[:len("v0.0.0-")] + "bogus", // malformed
+	} {
+		for _, ext := range []string{".info", ".mod", ".zip"} {
+			if w := get(p, "/example.com/m/@v/"+v+ext); w.Code != http.StatusNotFound {
+				t.Errorf("GET %s%s = %d, want 404", v, ext, w.Code)
+			}
+		}
+	}
+}
+
+func TestCheckRemote(t *testing.T) {
+	for _, tt := range []struct {
+		remote string
+		ok     bool
+	}{
+		{"https://example.com/repo.git", true},
+		{"ssh://git@example.com/repo.git", true},
+		{"http://example.com/repo.git", false},
+		{"file:///tmp/repo", false},
+		{"/tmp/repo", false},
+		{"-uhttps://example.com/repo", false},
+		{"--upload-pack=touch /tmp/x", false},
+		{"ext::sh -c touch% /tmp/x", false},
+		{"https:///repo", false},
+	} {
+		if err := checkRemote(tt.remote); (err == nil) != tt.ok {
+			t.Errorf("checkRemote(%q) = %v, want ok = %v", tt.remote, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// defaultSumDBKey is the verifier key of sum.golang.org, as built into the
+// go command
+const defaultSumDBKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+
+// verifyError reports a downloaded artifact whose hash does not match the
+// checksum database
+type verifyError struct {
+	module  string
+	version string
+	got     string
+	want    string
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("SECURITY ERROR: checksum mismatch for %s %s: downloaded %s, checksum database has %s",
+		e.module, e.version, e.got, e.want)
+}
+
+// verifier checks module zips and go.mod files against a checksum database
+// before they are committed to the cache
+type verifier struct {
+	name     string // checksum database name, e.g. sum.golang.org
+	client   *sumdb.Client
+	failures atomic.Int64 // artifacts rejected because of a mismatch
+}
+
+// newVerifier creates a verifier for the checksum database identified by key
+// (in GOSUMDB "name+hash+key" form). Modules matching the comma-separated
+// noSumDB glob patterns are not verified.
+func newVerifier(p *Proxy, key, noSumDB string) (*verifier, error) {
+	name, _, ok := strings.Cut(key, "+")
+	if !ok {
+		return nil, fmt.Errorf("invalid checksum database key %q", key)
+	}
+	client := sumdb.NewClient(&sumDBOps{proxy: p, name: name, key: key})
+	client.SetGONOSUMDB(noSumDB)
+	return &verifier{name: name, client: client}, nil
+}
+
+// verifyMod checks the go.mod of modPath@version against the checksum database
+func (v *verifier) verifyMod(modPath, version string, data []byte) error {
+	hash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		return err
+	}
+	return v.check(modPath, version+"/go.mod", hash)
+}
+
+// verifyZip checks the zip file of modPath@version against the checksum database
+func (v *verifier) verifyZip(modPath, version, zipFile string) error {
+	hash, err := dirhash.HashZip(zipFile, dirhash.Hash1)
+	if err != nil {
+		return fmt.Errorf("invalid module zip: %v", err)
+	}
+	return v.check(modPath, version, hash)
+}
+
+// check compares hash with the checksum database record for modPath at
+// version (which has a "/go.mod" suffix for go.mod hashes)
+func (v *verifier) check(modPath, version, hash string) error {
+	lines, err := v.client.Lookup(modPath, version)
+	if errors.Is(err, sumdb.ErrGONOSUMDB) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("checksum database lookup failed: %v", err)
+	}
+
+	prefix := modPath + " " + version + " "
+	for _, line := range lines {
+		if want, ok := strings.CutPrefix(line, prefix); ok {
+			if want == hash {
+				slog.Debug("Verified against checksum database", "module", modPath, "version", version, "hash", hash)
+				return nil
+			}
+			v.failures.Add(1)
+			verr := &verifyError{module: modPath, version: version, got: hash, want: want}
+			slog.Error(verr.Error(), "module", modPath, "version", version)
+			return verr
+		}
+	}
+	return fmt.Errorf("checksum database has no record for %s %s", modPath, version)
+}
+
+// sumDBOps implements sumdb.ClientOps on top of the proxy: remote reads use
+// the proxy's HTTP client (and so its -proxy/-dns settings) and the /sumdb/
+// routing of handleSumDB, and tiles share the on-disk tile cache.
+type sumDBOps struct {
+	proxy *Proxy
+	name  string
+	key   string
+}
+
+func (o *sumDBOps) ReadRemote(path string) ([]byte, error) {
+	ctx := context.Background()
+	url := o.proxy.sumDBURL(ctx, o.name, strings.TrimPrefix(path, "/"))
+	resp, err := o.proxy.upstream.openURL(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// configKey returns the cache key under which a verifier config file is kept
+func (o *sumDBOps) configKey(file string) string {
+	return "sumdb-verifier/" + file
+}
+
+func (o *sumDBOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	data, err := o.proxy.readCache(context.Background(), o.configKey(file))
+	if err != nil {
+		// Start from an empty signed tree
+		return []byte{}, nil
+	}
+	return data, nil
+}
+
+func (o *sumDBOps) WriteConfig(file string, old, new []byte) error {
+	ctx := context.Background()
+	key := o.configKey(file)
+	unlock := o.proxy.locks.Lock(key)
+	defer unlock()
+	current, err := o.proxy.readCache(ctx, key)
+	if err != nil {
+		current = []byte{}
+	}
+	if !bytes.Equal(current, old) {
+		return sumdb.ErrWriteConflict
+	}
+	return o.proxy.writeCache(ctx, key, new)
+}
+
+func (o *sumDBOps) ReadCache(file string) ([]byte, error) {
+	key := "sumdb/" + file
+	unlock := o.proxy.locks.RLock(key)
+	defer unlock()
+	return o.proxy.readCache(context.Background(), key)
+}
+
+func (o *sumDBOps) WriteCache(file string, data []byte) {
+	key := "sumdb/" + file
+	unlock := o.proxy.locks.Lock(key)
+	defer unlock()
+	if err := o.proxy.writeCache(context.Background(), key, data); err != nil {
+		slog.Warn("Failed to cache", "key", key, "err", err)
+	}
+}
+
+func (o *sumDBOps) Log(msg string) {
+	slog.Info(msg, "sumdb", o.name)
+}
+
+func (o *sumDBOps) SecurityError(msg string) {
+	slog.Error("SECURITY ERROR: "+msg, "sumdb", o.name)
+}
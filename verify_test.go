@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// testSumDB is a checksum database served under /sumdb/<name>/, as by a
+// module proxy that supports it
+type testSumDB struct {
+	name    string
+	key     string // verifier key
+	handler http.Handler
+}
+
+// newTestSumDB creates a checksum database holding records, the go.sum
+// lines of each module@version
+func newTestSumDB(t *testing.T, name string, records map[string]string) *testSumDB {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := sumdb.NewTestServer(skey, func(path, vers string) ([]byte, error) {
+		lines, ok := records[path+"@"+vers]
+		if !ok {
+			return nil, fmt.Errorf("no record for %s@%s", path, vers)
+		}
+		return []byte(lines), nil
+	})
+	return &testSumDB{
+		name:    name,
+		key:     vkey,
+		handler: http.StripPrefix("/sumdb/"+name, sumdb.NewServer(ops)),
+	}
+}
+
+func (db *testSumDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/sumdb/"+db.name+"/supported" {
+		return
+	}
+	db.handler.ServeHTTP(w, r)
+}
+
+// testModuleZip returns a module zip of modPath@version holding files, and
+// its hash
+func testModuleZip(t *testing.T, modPath, version string, files map[string]string) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(modPath + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "m.zip")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := dirhash.HashZip(file, dirhash.Hash1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), hash
+}
+
+// testModHash returns the hash of a go.mod file
+func testModHash(t *testing.T, data string) string {
+	t.Helper()
+	hash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestVerify(t *testing.T) {
+	const mod = "module example.com/m\n"
+	zipData, zipHash := testModuleZip(t, "example.com/m", "v1.0.0", map[string]string{"go.mod": mod, "m.go": "package m\n"})
+	modHash := testModHash(t, mod)
+
+	// v1.1.0 was tampered with upstream after it was recorded
+	tamperedZip, _ := testModuleZip(t, "example.com/m", "v1.1.0", map[string]string{"go.mod": mod, "m.go": "package m // tampered\n"})
+	tamperedMod := mod + "// tampered\n"
+	_, recordedZipHash := testModuleZip(t, "example.com/m", "v1.1.0", map[string]string{"go.mod": mod, "m.go": "package m\n"})
+
+	db := newTestSumDB(t, "sum.test", map[string]string{
+		"example.com/m@v1.0.0": fmt.Sprintf("example.com/m v1.0.0 %s\nexample.com/m v1.0.0/go.mod %s\n", zipHash, modHash),
+		"example.com/m@v1.1.0": fmt.Sprintf("example.com/m v1.1.0 %s\nexample.com/m v1.1.0/go.mod %s\n", recordedZipHash, modHash),
+	})
+	files := map[string]string{
+		"example.com/m/@v/v1.0.0.mod": mod,
+		"example.com/m/@v/v1.0.0.zip": string(zipData),
+		"example.com/m/@v/v1.1.0.mod": tamperedMod,
+		"example.com/m/@v/v1.1.0.zip": string(tamperedZip),
+	}
+	upstream := newFakeUpstream(t, nil)
+	upstream.handler = func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/sumdb/") {
+			db.ServeHTTP(w, r)
+			return
+		}
+		body, ok := files[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	}
+	storage := newMemStorage()
+	p := newTestProxyConfig(t, Config{Upstream: upstream.URL, Storage: storage, Verify: true, VerifyKey: db.key})
+
+	// Artifacts matching the checksum database are served and cached
+	for _, key := range []string{"example.com/m/@v/v1.0.0.mod", "example.com/m/@v/v1.0.0.zip"} {
+		if w := get(p, "/"+key); w.Code != http.StatusOK || w.Body.String() != files[key] {
+			t.Errorf("GET %s = %d %.100q", key, w.Code, w.Body)
+		}
+		if storage.data(key) == nil {
+			t.Errorf("verified %s not cached", key)
+		}
+	}
+
+	// Mismatching ones are neither
+	for _, key := range []string{"example.com/m/@v/v1.1.0.mod", "example.com/m/@v/v1.1.0.zip"} {
+		if w := get(p, "/"+key); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "SECURITY ERROR") {
+			t.Errorf("GET %s = %d %.100q, want a 502 security error", key, w.Code, w.Body)
+		}
+		if storage.data(key) != nil {
+			t.Errorf("mismatching %s cached", key)
+		}
+	}
+	if n := p.verifier.failures.Load(); n != 2 {
+		t.Errorf("%d verification failures, want 2", n)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultWarmConcurrency is how many module versions are warmed at once
+const defaultWarmConcurrency = 8
+
+// Formats of warm-up input
+const (
+	warmGoMod = "gomod" // a go.mod file: its requirements and replacements
+	warmGoSum = "gosum" // a go.sum file: every module version it lists
+	warmList  = "list"  // module@version lines; blank lines and # comments are ignored
+)
+
+// warmTarget is a module version to download into the cache
+type warmTarget struct {
+	module.Version
+	modOnly bool // only the go.mod is needed, as for go.sum "/go.mod" lines
+}
+
+// warmSet deduplicates warm targets. A full download supersedes a
+// go.mod-only one.
+type warmSet map[module.Version]bool // module version -> modOnly
+
+func (s warmSet) add(t warmTarget) {
+	if modOnly, ok := s[t.Version]; !ok || modOnly {
+		s[t.Version] = t.modOnly
+	}
+}
+
+// targets returns the targets in the set, sorted by module path and version
+func (s warmSet) targets() []warmTarget {
+	versions := make([]module.Version, 0, len(s))
+	for v := range s {
+		versions = append(versions, v)
+	}
+	module.Sort(versions)
+	targets := make([]warmTarget, len(versions))
+	for i, v := range versions {
+		targets[i] = warmTarget{Version: v, modOnly: s[v]}
+	}
+	return targets
+}
+
+// warmFormat returns the input format of the file name
+func warmFormat(name string) string {
+	switch ext := filepath.Ext(name); {
+	case ext == ".mod":
+		return warmGoMod
+	case ext == ".sum":
+		return warmGoSum
+	default:
+		return warmList
+	}
+}
+
+// parseWarmInput returns the module versions to warm named by data, in
+// format (see warmGoMod, warmGoSum and warmList)
+func parseWarmInput(format string, data []byte) ([]warmTarget, error) {
+	set := make(warmSet)
+	switch format {
+	case warmGoMod:
+		f, err := modfile.Parse("go.mod", data, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Replaced modules are never downloaded; their replacements are,
+		// unless they are local directories
+		replaced := make(map[module.Version]bool)
+		for _, r := range f.Replace {
+			replaced[r.Old] = true
+			if r.New.Version != "" {
+				set.add(warmTarget{Version: r.New})
+			}
+		}
+		for _, r := range f.Require {
+			if !replaced[r.Mod] && !replaced[module.Version{Path: r.Mod.Path}] {
+				set.add(warmTarget{Version: r.Mod})
+			}
+		}
+
+	case warmGoSum:
+		for i, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("line %d: malformed go.sum line", i+1)
+			}
+			version, modOnly := strings.CutSuffix(fields[1], "/go.mod")
+			set.add(warmTarget{Version: module.Version{Path: fields[0], Version: version}, modOnly: modOnly})
+		}
+
+	case warmList:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			t, err := parseModuleVersion(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			set.add(t)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid warm-up format %q (supported: %s, %s, %s)", format, warmGoMod, warmGoSum, warmList)
+	}
+	return set.targets(), nil
+}
+
+// parseModuleVersion parses a module@version argument. The version must be
+// canonical, since only those are cached.
+func parseModuleVersion(arg string) (warmTarget, error) {
+	path, version, ok := strings.Cut(arg, "@")
+	if !ok {
+		return warmTarget{}, fmt.Errorf("%q is not of the form module@version", arg)
+	}
+	if err := module.Check(path, version); err != nil {
+		return warmTarget{}, err
+	}
+	if version != module.CanonicalVersion(version) {
+		return warmTarget{}, fmt.Errorf("%s: version %q is not canonical", path, version)
+	}
+	return warmTarget{Version: module.Version{Path: path, Version: version}}, nil
+}
+
+// Outcomes of warming a module version
+const (
+	warmCached  = "cached"  // everything was already in the cache
+	warmFetched = "fetched" // at least one artifact was downloaded
+	warmFailed  = "failed"
+)
+
+// WarmResult reports the outcome of warming one module version
+type WarmResult struct {
+	Module  string `json:"module"`
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WarmReport summarizes a warm-up
+type WarmReport struct {
+	Cached  int          `json:"cached"`
+	Fetched int          `json:"fetched"`
+	Failed  int          `json:"failed"`
+	Results []WarmResult `json:"results"`
+}
+
+// warm downloads the .info, .mod and .zip (only the .mod for go.mod-only
+// targets) of every target into the cache through the normal fetch path, so
+// downloads are shared with concurrent client requests and verified like
+// them. At most concurrency versions are warmed at a time. Once ctx is done,
+// the remaining targets fail.
+func (p *Proxy) warm(ctx context.Context, targets []warmTarget, concurrency int) *WarmReport {
+	results := make([]WarmResult, len(targets))
+	var g errgroup.Group
+	g.SetLimit(max(concurrency, 1))
+	for i, t := range targets {
+		i, t := i, t
+		g.Go(func() error {
+			// Targets are fetched concurrently, so each needs an access
+			// record of its own
+			ctx := ctx
+			if rec, ok := ctx.Value(accessKey{}).(*accessRecord); ok {
+				ctx = withAccess(ctx, &accessRecord{id: rec.id})
+			}
+			results[i] = p.warmVersion(ctx, t)
+			return nil
+		})
+	}
+	g.Wait()
+
+	report := &WarmReport{Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case warmCached:
+			report.Cached++
+		case warmFetched:
+			report.Fetched++
+		default:
+			report.Failed++
+		}
+	}
+	slog.Info("Warmed cache", "cached", report.Cached, "fetched", report.Fetched, "failed", report.Failed)
+	return report
+}
+
+// warmVersion downloads the artifacts of one target that are not cached yet
+func (p *Proxy) warmVersion(ctx context.Context, t warmTarget) WarmResult {
+	res := WarmResult{Module: t.Path, Version: t.Version.Version, Status: warmCached}
+	exts := []string{".info", ".mod", ".zip"}
+	if t.modOnly {
+		exts = []string{".mod"}
+	}
+	for _, ext := range exts {
+		fetched, err := p.warmArtifact(ctx, t, ext)
+		if err != nil {
+			res.Status, res.Error = warmFailed, err.Error()
+			break
+		}
+		if fetched {
+			res.Status = warmFetched
+		}
+	}
+	return res
+}
+
+// warmArtifact downloads the artifact of t with extension ext unless it is
+// cached. It reports whether it downloaded it.
+func (p *Proxy) warmArtifact(ctx context.Context, t warmTarget, ext string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	key, err := versionKey(t.Path, t.Version.Version, ext)
+	if err != nil {
+		return false, err
+	}
+	mreq, err := parseRequest(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := p.storage.Stat(ctx, key); err == nil {
+		return false, nil
+	}
+
+	switch mreq.Kind {
+	case kindInfo:
+		_, err = p.fetchAndCache(ctx, mreq, true, validateJSON)
+	case kindMod:
+		_, err = p.fetchAndCache(ctx, mreq, true, p.modValidator(mreq))
+	default:
+		err = p.downloadZip(ctx, mreq)
+	}
+	if err != nil {
+		logFetchError(ctx, key, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// readWarmTargets returns the module versions named by the arguments of the
+// warm subcommand: go.mod, go.sum and list files (see warmFormat) and
+// module@version arguments
+func readWarmTargets(args []string) ([]warmTarget, error) {
+	set := make(warmSet)
+	for _, arg := range args {
+		data, err := os.ReadFile(arg)
+		if errors.Is(err, fs.ErrNotExist) && strings.Contains(arg, "@") {
+			t, err := parseModuleVersion(arg)
+			if err != nil {
+				return nil, err
+			}
+			set.add(t)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		targets, err := parseWarmInput(warmFormat(arg), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		for _, t := range targets {
+			set.add(t)
+		}
+	}
+	return set.targets(), nil
+}
+
+// runWarm runs the warm subcommand: it warms the cache of p with the module
+// versions named by args, prints a report and returns the exit status
+func runWarm(p *Proxy, args []string, concurrency int) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: goproxy warm [flags] go.mod|go.sum|file|module@version...")
+		return 2
+	}
+	if p.offline {
+		slog.Error("Cannot warm the cache in offline mode")
+		return 1
+	}
+	targets, err := readWarmTargets(args)
+	if err != nil {
+		slog.Error("Invalid warm-up input", "err", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	slog.Info("Warming cache", "versions", len(targets), "concurrency", concurrency)
+	report := p.warm(ctx, targets, concurrency)
+
+	for _, res := range report.Results {
+		switch res.Status {
+		case warmFetched:
+			fmt.Printf("fetched %s@%s\n", res.Module, res.Version)
+		case warmFailed:
+			fmt.Printf("failed  %s@%s: %s\n", res.Module, res.Version, res.Error)
+		}
+	}
+	fmt.Printf("%d cached, %d fetched, %d failed\n", report.Cached, report.Fetched, report.Failed)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}